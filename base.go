@@ -1,6 +1,7 @@
 package data_postgres
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -20,12 +21,37 @@ type (
 		Name  string
 		Value Map
 	}
+	//保存点，嵌套事务使用
+	//记录开始时的触发器和回调数量，回滚时只处理之后的部分
+	postgresSavepoint struct {
+		name      string
+		triggers  int
+		commits   int
+		rollbacks int
+	}
+	//事务中的一层，由BeginLevel返回
+	//Submit和Cancel只作用于这一层，这一层已经结束的话不会影响上一层
+	PostgresLevel struct {
+		base *PostgresBase
+		tx   *sql.Tx
+		//保存点名称，为空表示最外层的事务
+		savepoint string
+		done      bool
+	}
+	//事务选项，Deferrable只在SERIALIZABLE READ ONLY下有效
+	PostgresTxOptions struct {
+		sql.TxOptions
+		Deferrable bool
+	}
 	PostgresBase struct {
 		connect *PostgresConnect
 
 		name   string
 		schema string
 
+		//所有操作使用的context，默认Background
+		ctx context.Context
+
 		tx   *sql.Tx
 		exec PostgresExecutor
 		// cache data.CacheBase
@@ -36,6 +62,28 @@ type (
 		manual   bool
 		triggers []postgresTrigger
 
+		//事务提交和回滚后的回调
+		commits   []func()
+		rollbacks []func()
+
+		//会话级咨询锁，固定在一个连接上，locks为每个锁的次数
+		lockconn *sql.Conn
+		locks    map[int64]int
+
+		//两阶段提交中，已预提交等待提交的事务
+		prepared *postgresPrepared
+
+		//嵌套事务的保存点，在事务中再次Begin时使用
+		//sequence为事务中创建过的保存点数量，用来生成不重复的名称
+		savepoints []postgresSavepoint
+		sequence   int
+
+		//事务选项，开始事务时使用
+		options PostgresTxOptions
+
+		//事务需要重启，遇到序列化失败或死锁时标记
+		restart bool
+
 		lastError error
 	}
 )
@@ -108,15 +156,30 @@ func (base *PostgresBase) modelConfig(name string) *data.Model {
 
 func (base *PostgresBase) errorHandler(key string, err error, args ...Any) {
 	if err != nil {
-		//出错自动取消事务
+		//出错自动取消事务，嵌套时只回滚当前层
 		base.Cancel()
 
-		errors := []Any{key, err}
-		errors = append(errors, args...)
+		logs := []Any{key, err}
+		logs = append(logs, args...)
 
-		base.lastError = err
-		log.Warning(errors...)
+		if restartable(err) {
+			base.restart = true
+		}
+
+		//按SQLSTATE分类，调用方可以用errors.Is判断
+		base.lastError = classify(base.ctx, err)
+		log.Warning(logs...)
+	}
+}
+
+// 设置context，之后的所有操作都会使用
+// 请求取消或超时时，正在执行的查询会被中止
+func (base *PostgresBase) WithContext(ctx context.Context) *PostgresBase {
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	base.ctx = ctx
+	return base
 }
 
 // 关闭数据库
@@ -130,9 +193,14 @@ func (base *PostgresBase) Close() error {
 		//关闭时候,一定要提交一次事务
 		//如果手动提交了, 这里会失败, 问题不大
 		//如果没有提交的话, 连接不会交回连接池. 会一直占用
+		//有保存点的话，直接回滚整个事务
+		base.savepoints = nil
 		base.Cancel()
 	}
 
+	//会话级锁要释放，不然会跟着连接回到连接池
+	base.unlockAll()
+
 	// if base.cache != nil {
 	// 	base.cache.Close()
 	// }
@@ -200,11 +268,19 @@ func (base *PostgresBase) Serial(key string, start, step int64) int64 {
 		step = 1
 	}
 
-	sql := fmt.Sprintf(
-		`CREATE SEQUENCE IF NOT EXISTS "%s" START %d INCREMENT %d; select nextval('%s');`,
-		serial, start, step, serial,
-	)
-	row := exec.QueryRow(sql)
+	//建序列和取值分两条语句执行
+	//pgx会预处理语句，cockroach也不支持一次执行多条语句再返回结果
+	var row *sql.Row
+	if base.connect.setting.Dialect == DialectCockroach && base.connect.setting.RowID {
+		row = exec.QueryRowContext(base.ctx, `SELECT unique_rowid()`)
+	} else {
+		_, err = exec.ExecContext(base.ctx, fmt.Sprintf(`CREATE SEQUENCE IF NOT EXISTS "%s" START %d INCREMENT %d`, serial, start, step))
+		if err != nil {
+			base.errorHandler("data.serial.create", err, key)
+			return 0
+		}
+		row = exec.QueryRowContext(base.ctx, fmt.Sprintf(`SELECT nextval('"%s"')`, serial))
+	}
 
 	seq := int64(0)
 
@@ -234,7 +310,7 @@ func (base *PostgresBase) Break(key string) {
 	}
 
 	sql := fmt.Sprintf(`DELETE FROM "%s" WHERE "key"=$1`, serial)
-	_, err = exec.Exec(sql, key)
+	_, err = exec.ExecContext(base.ctx, sql, key)
 	if err != nil {
 		base.errorHandler("data.break.delete", err, key)
 		return
@@ -263,9 +339,13 @@ func (base *PostgresBase) Table(name string) data.DataTable {
 			fields[k] = v
 		}
 
+		//联合主键用逗号分隔，比如 tenant,id
+		keys := splitKeys(key)
+
 		table = strings.Replace(table, ".", "_", -1)
 		return &PostgresTable{
-			PostgresView{base, name, schema, table, key, fields},
+			PostgresView{base, name, schema, table, keys[0], keys, fields, "", true},
+			hypertableSetting(config.Setting),
 		}
 	} else {
 		panic("[数据]表不存在")
@@ -295,9 +375,11 @@ func (base *PostgresBase) View(name string) data.DataView {
 			fields[k] = v
 		}
 
+		keys := splitKeys(key)
+
 		view = strings.Replace(view, ".", "_", -1)
 		return &PostgresView{
-			base, name, schema, view, key, fields,
+			base, name, schema, view, keys[0], keys, fields, base.connect.setting.Follower, false,
 		}
 	} else {
 		panic("[数据]视图不存在")
@@ -340,23 +422,150 @@ func (base *PostgresBase) Model(name string) data.DataModel {
 // }
 
 // 开启手动模式
+// 已经在事务中时，使用保存点开启嵌套事务，Submit和Cancel作用于最内层
+// 嵌套时要defer取消的，使用BeginLevel
 func (base *PostgresBase) Begin() (*sql.Tx, error) {
+	return base.BeginTx(PostgresTxOptions{})
+}
+
+// 开启一层事务，返回这一层的句柄
+// 按 level, err := BeginLevel(); defer level.Cancel(); ...; level.Submit() 使用
+// 出错自动回滚过的层，Cancel什么也不做，Submit返回错误
+func (base *PostgresBase) BeginLevel() (*PostgresLevel, error) {
+	return base.beginLevel(PostgresTxOptions{})
+}
+
+func (base *PostgresBase) beginLevel(opts PostgresTxOptions) (*PostgresLevel, error) {
+	nested := base.tx != nil
+	tx, err := base.BeginTx(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	level := &PostgresLevel{base: base, tx: tx}
+	if nested {
+		level.savepoint = base.savepoints[len(base.savepoints)-1].name
+	}
+	return level, nil
+}
+
+// 这一层在事务中的位置，0为最外层，-1表示已经结束
+func (level *PostgresLevel) index() int {
+	base := level.base
+	if level.done || base.tx == nil || base.tx != level.tx {
+		return -1
+	}
+	if level.savepoint == "" {
+		return 0
+	}
+	for i, savepoint := range base.savepoints {
+		if savepoint.name == level.savepoint {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// 提交这一层，内层没有结束的保存点一起释放
+func (level *PostgresLevel) Submit() error {
+	index := level.index()
+	level.done = true
+	if index < 0 {
+		return errors.New("[数据]事务已经结束")
+	}
+
+	base := level.base
+	base.savepoints = base.savepoints[:index]
+	return base.Submit()
+}
+
+// 取消这一层，内层没有结束的保存点一起回滚
+// 这一层已经结束的，什么也不做，可以放在defer中
+func (level *PostgresLevel) Cancel() error {
+	index := level.index()
+	level.done = true
+	if index < 0 {
+		return nil
+	}
+
+	base := level.base
+	base.savepoints = base.savepoints[:index]
+	return base.Cancel()
+}
+
+// 开启手动模式，并指定隔离级别、只读等选项
+// 选项无效时，错误可以从Erred()拿到
+func (base *PostgresBase) BeginTx(opts PostgresTxOptions) (*sql.Tx, error) {
 	base.lastError = nil
+
+	if err := base.checkTx(opts); err != nil {
+		//还没有开启事务，不能用errorHandler，会取消上一层
+		base.lastError = err
+		log.Warning("data.begin.options", err, base.name)
+		return nil, err
+	}
+
+	if base.tx != nil {
+		return base.tx, base.savepoint()
+	}
+
 	base.manual = true
+	base.options = opts
 	return base.beginTx()
 }
 
+// 检查事务选项
+func (base *PostgresBase) checkTx(opts PostgresTxOptions) error {
+	switch opts.Isolation {
+	case sql.LevelDefault, sql.LevelReadUncommitted, sql.LevelReadCommitted, sql.LevelRepeatableRead, sql.LevelSerializable:
+	default:
+		return fmt.Errorf("[数据]不支持的隔离级别：%v", opts.Isolation)
+	}
+
+	if opts.Deferrable && (opts.Isolation != sql.LevelSerializable || !opts.ReadOnly) {
+		return errors.New("[数据]DEFERRABLE只能用于SERIALIZABLE READ ONLY事务")
+	}
+
+	//嵌套事务使用保存点，不能修改隔离级别
+	if base.tx != nil && opts != (PostgresTxOptions{}) {
+		return errors.New("[数据]嵌套事务不能指定事务选项")
+	}
+
+	return nil
+}
+
+// 创建保存点
+func (base *PostgresBase) savepoint() error {
+	base.sequence++
+	name := fmt.Sprintf("sp_%d", base.sequence)
+	if _, err := base.tx.ExecContext(base.ctx, fmt.Sprintf(`SAVEPOINT "%s"`, name)); err != nil {
+		return err
+	}
+	base.savepoints = append(base.savepoints, postgresSavepoint{
+		name: name, triggers: len(base.triggers), commits: len(base.commits), rollbacks: len(base.rollbacks),
+	})
+	return nil
+}
+
 // 注意，此方法为实际开始事务
 func (base *PostgresBase) beginTx() (*sql.Tx, error) {
 	if base.tx != nil {
 		return base.tx, nil
 	}
 
-	tx, err := base.connect.db.Begin()
+	tx, err := base.connect.db.BeginTx(base.ctx, &base.options.TxOptions)
 	if err != nil {
 		return nil, err
 	}
 
+	//DEFERRABLE必须在事务的第一条语句之前设置
+	if base.options.Deferrable {
+		if _, err := tx.ExecContext(base.ctx, `SET TRANSACTION DEFERRABLE`); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
 	base.tx = tx
 	base.exec = tx
 
@@ -369,6 +578,11 @@ func (base *PostgresBase) endTx() error {
 	base.exec = nil
 	base.manual = false
 	base.triggers = []postgresTrigger{}
+	base.commits = nil
+	base.rollbacks = nil
+	base.savepoints = nil
+	base.sequence = 0
+	base.options = PostgresTxOptions{}
 	return nil
 }
 
@@ -376,58 +590,221 @@ func (base *PostgresBase) beginExec() (PostgresExecutor, error) {
 	if base.manual {
 		_, err := base.beginTx()
 		return base.exec, err
+	} else if base.connect.setting.RetryTimes > 0 {
+		//自动提交模式下才重试，事务中绝不重试
+		return &postgresRetry{base.connect, false, base.connect.writer, nil}, nil
 	} else {
 		return base.connect.db, nil
 	}
 }
 
+// 只读操作，非手动事务时优先使用只读副本
+// 没有可用副本时回退到主库
+func (base *PostgresBase) readExec() (PostgresExecutor, error) {
+	if base.manual {
+		return base.beginExec()
+	}
+	if base.connect.setting.RetryTimes > 0 {
+		return &postgresRetry{base.connect, true, base.connect.reader, nil}, nil
+	}
+	return base.connect.reader(), nil
+}
+
+// 只读操作，但必须使用主库
+// 先读后写的场景，副本有延迟时会读不到刚写入的数据
+func (base *PostgresBase) primaryExec() (PostgresExecutor, error) {
+	if base.manual {
+		return base.beginExec()
+	}
+	if base.connect.setting.RetryTimes > 0 {
+		return &postgresRetry{base.connect, true, base.connect.writer, nil}, nil
+	}
+	return base.connect.db, nil
+}
+
 // 提交事务
+// 嵌套事务只释放最内层的保存点，触发器合并到上一层
 func (base *PostgresBase) Submit() error {
-	//不管成功失败，都结束事务
-	defer base.endTx()
+	if count := len(base.savepoints); count > 0 {
+		savepoint := base.savepoints[count-1]
+		base.savepoints = base.savepoints[:count-1]
+
+		_, err := base.tx.ExecContext(base.ctx, fmt.Sprintf(`RELEASE SAVEPOINT "%s"`, savepoint.name))
+		return err
+	}
 
 	if base.tx == nil {
+		base.endTx()
 		return errors.New("[数据]无效事务")
 	}
 
+	//不管成功失败，都结束事务
+	//先结束再回调，回调里可以继续使用base
+	triggers, commits, rollbacks := base.triggers, base.commits, base.rollbacks
 	err := base.tx.Commit()
+	base.endTx()
+
 	if err != nil {
+		//提交失败，事务已经回滚
+		for _, hook := range rollbacks {
+			hook()
+		}
 		return err
 	}
 
+	//已经提交，内层标记的重启不再有效
+	base.restart = false
+
 	//提交事务后,要把触发器都发掉
-	for _, trigger := range base.triggers {
+	for _, trigger := range triggers {
 		data.Trigger(trigger.Name, trigger.Value)
 	}
+	for _, hook := range commits {
+		hook()
+	}
 
 	return nil
 }
 
 // 取消事务
+// 嵌套事务只回滚到最内层的保存点，并丢弃保存点之后的触发器
 func (base *PostgresBase) Cancel() error {
+	if count := len(base.savepoints); count > 0 {
+		savepoint := base.savepoints[count-1]
+		base.savepoints = base.savepoints[:count-1]
+		return base.rollbackTo(savepoint)
+	}
+
 	if base.tx == nil {
 		return errors.New("[数据]无效事务")
 	}
 
+	//context取消时database/sql已经回滚了，会返回ErrTxDone
+	//不管回滚是否成功，事务都结束了，都要清理并执行回调
 	err := base.tx.Rollback()
-	if err != nil {
-		return err
+	if errors.Is(err, sql.ErrTxDone) {
+		err = nil
 	}
 
-	//提交后,要清掉事务
+	rollbacks := base.rollbacks
 	base.endTx()
 
-	return nil
+	for _, hook := range rollbacks {
+		hook()
+	}
+
+	return err
+}
+
+// 回滚到保存点，丢弃之后的触发器和回调，并执行这一层的回滚回调
+func (base *PostgresBase) rollbackTo(savepoint postgresSavepoint) error {
+	base.triggers = base.triggers[:savepoint.triggers]
+	base.commits = base.commits[:savepoint.commits]
+
+	rollbacks := base.rollbacks[savepoint.rollbacks:]
+	base.rollbacks = base.rollbacks[:savepoint.rollbacks:savepoint.rollbacks]
+
+	_, err := base.tx.ExecContext(base.ctx, fmt.Sprintf(`ROLLBACK TO SAVEPOINT "%s"`, savepoint.name))
+	if err == nil {
+		_, err = base.tx.ExecContext(base.ctx, fmt.Sprintf(`RELEASE SAVEPOINT "%s"`, savepoint.name))
+	}
+
+	for _, hook := range rollbacks {
+		hook()
+	}
+
+	return err
+}
+
+// 是否在嵌套事务中
+func (base *PostgresBase) nested() bool {
+	return len(base.savepoints) > 0
+}
+
+// 事务提交后执行，嵌套事务回滚时会丢弃
+// 不在事务中时直接执行
+func (base *PostgresBase) OnCommit(hook func()) {
+	if hook == nil {
+		return
+	}
+	if base.tx == nil {
+		hook()
+		return
+	}
+	base.commits = append(base.commits, hook)
+}
+
+// 事务回滚后执行，包括出错自动回滚
+// 嵌套事务回滚时，只执行这一层注册的
+// 不在事务中时忽略
+func (base *PostgresBase) OnRollback(hook func()) {
+	if hook == nil || base.tx == nil {
+		return
+	}
+	base.rollbacks = append(base.rollbacks, hook)
 }
 
 // 批量操作，包装事务
+// 遇到序列化失败(40001)或死锁(40P01)时，回滚后重新执行next
 func (base *PostgresBase) Batch(next data.BatchFunc) Res {
-	base.Begin()
-	defer base.Cancel()
+	return base.BatchTx(PostgresTxOptions{}, next)
+}
+
+// 批量操作，指定事务选项
+func (base *PostgresBase) BatchTx(opts PostgresTxOptions, next data.BatchFunc) Res {
+	//嵌套的Batch使用保存点，事务重启只能由最外层处理
+	retries := 0
+	if base.tx == nil {
+		retries = base.connect.setting.Retries
+	}
+
+	for i := 0; ; i++ {
+		//只有这次失败了才重启，已经提交的不能再执行
+		res := base.batch(opts, next)
+		if !res.Fail() || !base.restart || i >= retries {
+			return res
+		}
+
+		//回滚时触发器已经丢弃，等待后重新执行
+		log.Warning("data.batch.restart", base.name, i+1, base.lastError)
+		timer := time.NewTimer(backoff(base.connect.setting.RetryBackoff, base.connect.setting.RetryMaxBackoff, i))
+		select {
+		case <-base.ctx.Done():
+			timer.Stop()
+			return res
+		case <-timer.C:
+		}
+	}
+}
+
+// 执行一次批量操作
+func (base *PostgresBase) batch(opts PostgresTxOptions, next data.BatchFunc) Res {
+	//嵌套时保留外层的标记
+	if base.tx == nil {
+		base.restart = false
+	}
+	level, err := base.beginLevel(opts)
+	if err != nil {
+		//保存点没有建立，不能用errorHandler，会取消上一层
+		base.lastError = err
+		log.Warning("data.batch.begin", err, base.name)
+		return infra.Fail
+	}
+
+	//只取消本层，已经提交或是出错自动回滚的，Cancel什么也不做
+	defer level.Cancel()
+
 	if res := next(); res.Fail() {
 		return res
 	} else {
-		if err := base.Submit(); err != nil {
+		if err := level.Submit(); err != nil {
+			if restartable(err) {
+				base.restart = true
+			}
+			//已经自动回滚的，保留原来的错误
+			if base.lastError == nil {
+				base.lastError = classify(base.ctx, err)
+			}
 			return infra.Fail
 		}
 		if res != nil {
@@ -584,6 +961,25 @@ func (base *PostgresBase) unpacking(keys []string, vals []interface{}) Map {
 	return m
 }
 
+// 从查询参数中拿出行锁
+// 行锁只能在手动事务中使用，自动提交时锁会立即释放，没有意义
+func (base *PostgresBase) locking(args ...Any) (string, []Any, error) {
+	lock, others := "", []Any{}
+	for _, arg := range args {
+		if vv, ok := arg.(PostgresLock); ok {
+			lock = string(vv)
+		} else {
+			others = append(others, arg)
+		}
+	}
+
+	if lock != "" && !base.manual {
+		return "", args, errors.New("[数据]行锁只能在事务中使用")
+	}
+
+	return lock, others, nil
+}
+
 // 把MAP编译成sql查询条件
 func (base *PostgresBase) parsing(i int, args ...Any) (string, []interface{}, string, error) {
 
@@ -1,10 +1,19 @@
 package data_postgres
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/infrago/data"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
 type (
@@ -19,31 +28,317 @@ type (
 		//数据库对象
 		db      *sql.DB
 		actives int64
+
+		//只读副本，cursor用于轮询
+		replicas []*postgresReplica
+		cursor   uint64
+
+		//自动重试的次数统计
+		retries int64
 	}
 
 	PostgresSetting struct {
 		Schema string
+
+		//database/sql驱动名，默认postgres即lib/pq，可选pgx
+		Driver string
+
+		//方言，根据注册名或URL判断
+		Dialect string
+
+		//Batch遇到序列化失败或死锁时的重试次数，cockroach默认3次
+		Retries int
+
+		//cockroach专用
+		//RowID表示Serial直接使用unique_rowid()
+		//Follower为AS OF SYSTEM TIME的时间表达式，视图读取时使用
+		RowID    bool
+		Follower string
+
+		//多主机，以及target_session_attrs
+		//主库切换后，新建立的连接会连到符合要求的节点
+		Hosts  []string
+		Target string
+
+		//TLS设置，Server用于覆盖证书校验的服务器名
+		SSLMode   string
+		SSLCA     string
+		SSLCert   string
+		SSLKey    string
+		SSLServer string
+
+		//会话设置，每个新连接建立时生效
+		SearchPath       string
+		StatementTimeout time.Duration
+		LockTimeout      time.Duration
+		IdleTimeout      time.Duration
+		Application      string
+
+		//自动提交模式下的重试策略，RetryTimes为0时不重试
+		//退避时间同时用于Batch的重试
+		RetryTimes      int
+		RetryBackoff    time.Duration
+		RetryMaxBackoff time.Duration
+
+		//连接池设置，0表示使用database/sql的默认值
+		//MaxIdle为-1时使用默认值，0表示不保留空闲连接
+		MaxOpen  int
+		MaxIdle  int
+		Lifetime time.Duration
+		IdleTime time.Duration
+
+		//健康检查ping的超时时间
+		HealthTimeout time.Duration
+
+		//只读副本地址，以及副本失败后多久重新尝试
+		Replicas     []string
+		ReplicaRetry time.Duration
+	}
+
+	//连接池状态
+	PostgresStats struct {
+		Actives      int64
+		Open         int
+		InUse        int
+		Idle         int
+		WaitCount    int64
+		WaitDuration time.Duration
+		Retries      int64
 	}
 )
 
 // 打开连接
 func (this *PostgresConnect) Open() error {
-	db, err := sql.Open("postgres", this.instance.Config.Url)
-	if err == nil {
-		this.db = db
+	db, err := this.openDB(this.instance.Config.Url, true)
+	if err != nil {
+		return err
+	}
+
+	//只读副本
+	replicas := []*postgresReplica{}
+	for _, url := range this.setting.Replicas {
+		rdb, err := this.openDB(url, false)
+		if err != nil {
+			for _, replica := range replicas {
+				replica.db.Close()
+			}
+			db.Close()
+			return err
+		}
+		replicas = append(replicas, &postgresReplica{connect: this, url: url, db: rdb})
+	}
+
+	this.db = db
+	this.replicas = replicas
+
+	return nil
+}
+
+// 打开一个连接池，并应用连接池设置
+// primary表示主库，只读副本不使用target_session_attrs
+func (this *PostgresConnect) openDB(url string, primary bool) (*sql.DB, error) {
+	url = this.dsn(url, primary)
+
+	var db *sql.DB
+	if this.setting.Driver == "pgx" {
+		config, err := pgx.ParseConfig(url)
+		if err != nil {
+			return nil, err
+		}
+
+		//指定证书校验的服务器名
+		if this.setting.SSLServer != "" {
+			if config.TLSConfig != nil {
+				config.TLSConfig.ServerName = this.setting.SSLServer
+			}
+			for _, fallback := range config.Fallbacks {
+				if fallback.TLSConfig != nil {
+					fallback.TLSConfig.ServerName = this.setting.SSLServer
+				}
+			}
+		}
+
+		db = stdlib.OpenDB(*config)
+	} else {
+		//lib/pq和pgx一样支持多主机和target_session_attrs
+		pdb, err := sql.Open(this.setting.Driver, url)
+		if err != nil {
+			return nil, err
+		}
+		db = pdb
+	}
+
+	//连接池设置
+	if this.setting.MaxOpen > 0 {
+		db.SetMaxOpenConns(this.setting.MaxOpen)
+	}
+	if this.setting.MaxIdle >= 0 {
+		db.SetMaxIdleConns(this.setting.MaxIdle)
+	}
+	if this.setting.Lifetime > 0 {
+		db.SetConnMaxLifetime(this.setting.Lifetime)
+	}
+	if this.setting.IdleTime > 0 {
+		db.SetConnMaxIdleTime(this.setting.IdleTime)
+	}
+
+	return db, nil
+}
+
+// 把TLS和会话等设置加到连接串中
+// 支持URL和key=value两种格式，多主机只支持URL格式
+// target只用于主库，副本加上read-write会连不上
+func (this *PostgresConnect) dsn(dsn string, primary bool) string {
+	params := [][2]string{}
+	if primary && this.setting.Target != "" {
+		params = append(params, [2]string{"target_session_attrs", this.setting.Target})
+	}
+	if this.setting.SSLMode != "" {
+		params = append(params, [2]string{"sslmode", this.setting.SSLMode})
+	}
+	if this.setting.SSLCA != "" {
+		params = append(params, [2]string{"sslrootcert", this.setting.SSLCA})
+	}
+	if this.setting.SSLCert != "" {
+		params = append(params, [2]string{"sslcert", this.setting.SSLCert})
+		params = append(params, [2]string{"sslkey", this.setting.SSLKey})
 	}
-	return err
+
+	//会话设置，作为启动参数发送，连接池中每个新连接都会生效
+	if this.setting.SearchPath != "" {
+		params = append(params, [2]string{"search_path", this.setting.SearchPath})
+	}
+	if this.setting.StatementTimeout > 0 {
+		params = append(params, [2]string{"statement_timeout", fmt.Sprintf("%d", this.setting.StatementTimeout.Milliseconds())})
+	}
+	if this.setting.LockTimeout > 0 {
+		params = append(params, [2]string{"lock_timeout", fmt.Sprintf("%d", this.setting.LockTimeout.Milliseconds())})
+	}
+	if this.setting.IdleTimeout > 0 {
+		params = append(params, [2]string{"idle_in_transaction_session_timeout", fmt.Sprintf("%d", this.setting.IdleTimeout.Milliseconds())})
+	}
+	if this.setting.Application != "" {
+		params = append(params, [2]string{"application_name", this.setting.Application})
+	}
+
+	if len(params) == 0 {
+		return dsn
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") {
+		return setParams(dsn, params)
+	}
+
+	for _, param := range params {
+		dsn += fmt.Sprintf(" %s='%s'", param[0], strings.Replace(param[1], "'", `\'`, -1))
+	}
+	return dsn
+}
+
+// 拆分多主机URL，返回前缀、主机列表、后缀
+// postgres://user:pass@h1:5432,h2:5432/db?sslmode=require
+func splitHosts(dsn string) (string, []string, string) {
+	scheme := strings.Index(dsn, "://")
+	if scheme < 0 {
+		return dsn, nil, ""
+	}
+
+	rest := dsn[scheme+3:]
+	end := strings.IndexAny(rest, "/?")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	head := dsn[:scheme+3]
+	hosts := rest[:end]
+	if at := strings.LastIndex(hosts, "@"); at >= 0 {
+		head += hosts[:at+1]
+		hosts = hosts[at+1:]
+	}
+
+	return head, strings.Split(hosts, ","), rest[end:]
+}
+
+// 设置URL的查询参数，不使用url.Parse，因为它不支持多主机
+func setParams(dsn string, params [][2]string) string {
+	base, raw := dsn, ""
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		base, raw = dsn[:i], dsn[i+1:]
+	}
+
+	query, err := url.ParseQuery(raw)
+	if err != nil {
+		query = url.Values{}
+	}
+	for _, param := range params {
+		if param[1] == "" {
+			query.Del(param[0])
+		} else {
+			query.Set(param[0], param[1])
+		}
+	}
+
+	if encoded := query.Encode(); encoded != "" {
+		return base + "?" + encoded
+	}
+	return base
 }
 
 // 健康检查
+// 会实际ping一次数据库，失败时返回错误
 func (this *PostgresConnect) Health() (data.Health, error) {
 	this.mutex.RLock()
-	defer this.mutex.RUnlock()
-	return data.Health{Workload: this.actives}, nil
+	db, actives := this.db, this.actives
+	this.mutex.RUnlock()
+
+	health := data.Health{Workload: actives}
+	if db == nil {
+		return health, errors.New("[数据]连接未打开")
+	}
+
+	timeout := this.setting.HealthTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 3
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	//负载还是打开的base数量，连接池状态见Stats()
+	if err := db.PingContext(ctx); err != nil {
+		stats := this.Stats()
+		return health, fmt.Errorf("[数据]健康检查失败：%v (open=%d inuse=%d idle=%d wait=%d/%v)", err, stats.Open, stats.InUse, stats.Idle, stats.WaitCount, stats.WaitDuration)
+	}
+
+	return health, nil
+}
+
+// 连接池状态
+func (this *PostgresConnect) Stats() PostgresStats {
+	this.mutex.RLock()
+	db, actives := this.db, this.actives
+	this.mutex.RUnlock()
+
+	stats := PostgresStats{Actives: actives, Retries: atomic.LoadInt64(&this.retries)}
+	if db != nil {
+		dbs := db.Stats()
+		stats.Open = dbs.OpenConnections
+		stats.InUse = dbs.InUse
+		stats.Idle = dbs.Idle
+		stats.WaitCount = dbs.WaitCount
+		stats.WaitDuration = dbs.WaitDuration
+	}
+
+	return stats
 }
 
 // 关闭连接
 func (this *PostgresConnect) Close() error {
+	for _, replica := range this.replicas {
+		replica.db.Close()
+	}
+	this.replicas = nil
+
 	if this.db != nil {
 		err := this.db.Close()
 		if err != nil {
@@ -59,5 +354,8 @@ func (this *PostgresConnect) Base() data.DataBase {
 	this.actives++
 	this.mutex.Unlock()
 
-	return &PostgresBase{this, this.instance.Name, this.setting.Schema, nil, nil, false, []postgresTrigger{}, nil}
+	return &PostgresBase{
+		connect: this, name: this.instance.Name, schema: this.setting.Schema,
+		ctx: context.Background(), triggers: []postgresTrigger{},
+	}
 }
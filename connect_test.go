@@ -0,0 +1,123 @@
+package data_postgres
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitHosts(t *testing.T) {
+	tests := []struct {
+		dsn   string
+		head  string
+		hosts []string
+		tail  string
+	}{
+		{
+			"postgres://user:pass@h1:5432,h2:5432/db?sslmode=require",
+			"postgres://user:pass@", []string{"h1:5432", "h2:5432"}, "/db?sslmode=require",
+		},
+		{
+			"postgres://h1/db",
+			"postgres://", []string{"h1"}, "/db",
+		},
+		{
+			"postgres://user:p@ss@h1,h2?sslmode=disable",
+			"postgres://user:p@ss@", []string{"h1", "h2"}, "?sslmode=disable",
+		},
+		{
+			"postgres://user@h1:5432",
+			"postgres://user@", []string{"h1:5432"}, "",
+		},
+		{
+			"host=h1 dbname=db",
+			"host=h1 dbname=db", nil, "",
+		},
+	}
+
+	for _, test := range tests {
+		head, hosts, tail := splitHosts(test.dsn)
+		if head != test.head || !reflect.DeepEqual(hosts, test.hosts) || tail != test.tail {
+			t.Errorf("%s：%q %q %q", test.dsn, head, hosts, tail)
+		}
+	}
+}
+
+func TestSetParams(t *testing.T) {
+	tests := []struct {
+		dsn    string
+		params [][2]string
+		want   string
+	}{
+		{
+			"postgres://h1/db",
+			[][2]string{{"sslmode", "require"}},
+			"postgres://h1/db?sslmode=require",
+		},
+		{
+			"postgres://h1,h2/db?sslmode=disable&connect_timeout=5",
+			[][2]string{{"sslmode", "require"}, {"application_name", "app"}},
+			"postgres://h1,h2/db?application_name=app&connect_timeout=5&sslmode=require",
+		},
+		{
+			"postgres://h1/db?target_session_attrs=read-write",
+			[][2]string{{"target_session_attrs", ""}},
+			"postgres://h1/db",
+		},
+		{
+			"postgres://h1/db",
+			[][2]string{{"search_path", "a,b c"}},
+			"postgres://h1/db?search_path=a%2Cb+c",
+		},
+	}
+
+	for _, test := range tests {
+		if dsn := setParams(test.dsn, test.params); dsn != test.want {
+			t.Errorf("%s：%s，应为%s", test.dsn, dsn, test.want)
+		}
+	}
+}
+
+func TestDsn(t *testing.T) {
+	setting := PostgresSetting{
+		Target:           "read-write",
+		SSLMode:          "verify-full",
+		SSLCA:            "/ca.pem",
+		StatementTimeout: time.Second * 30,
+		Application:      "o'app",
+	}
+
+	tests := []struct {
+		name    string
+		setting PostgresSetting
+		dsn     string
+		primary bool
+		want    string
+	}{
+		{
+			"没有设置", PostgresSetting{}, "postgres://h1/db", true,
+			"postgres://h1/db",
+		},
+		{
+			"主库URL", setting, "postgres://h1,h2/db?sslmode=disable", true,
+			"postgres://h1,h2/db?application_name=o%27app&sslmode=verify-full&sslrootcert=%2Fca.pem&statement_timeout=30000&target_session_attrs=read-write",
+		},
+		{
+			"副本不加target", setting, "postgres://r1/db", false,
+			"postgres://r1/db?application_name=o%27app&sslmode=verify-full&sslrootcert=%2Fca.pem&statement_timeout=30000",
+		},
+		{
+			"key=value格式", setting, "host=h1 dbname=db", false,
+			`host=h1 dbname=db sslmode='verify-full' sslrootcert='/ca.pem' statement_timeout='30000' application_name='o\'app'`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connect := &PostgresConnect{setting: test.setting}
+			if dsn := connect.dsn(test.dsn, test.primary); dsn != test.want {
+				t.Fatalf("%s\n应为%s", dsn, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package data_postgres
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	. "github.com/infrago/base"
+	"github.com/infrago/infra"
+	"github.com/infrago/log"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+type (
+	//COPY导入选项
+	PostgresCopy struct {
+		//导入的字段，默认为表的全部字段，单主键时不含主键
+		//行里没有的字段写入NULL，不使用默认值
+		Columns []string
+
+		//跳过无效的行，默认遇到第一条无效的行就中止导入
+		Skip bool
+
+		//进度回调，每Every行调用一次，Every默认10000
+		Progress func(count int64)
+		Every    int64
+	}
+
+	//COPY的数据源，同时实现pgx.CopyFromSource
+	postgresCopySource struct {
+		table   *PostgresTable
+		opts    PostgresCopy
+		next    func() (Map, bool)
+		values  []Any
+		count   int64
+		skipped int64
+		err     error
+	}
+)
+
+func (source *postgresCopySource) Next() bool {
+	for {
+		item, ok := source.next()
+		if !ok {
+			return false
+		}
+
+		values, err := source.table.copyRow(source.opts.Columns, item)
+		if err != nil {
+			if source.opts.Skip {
+				source.skipped++
+				log.Warning("data.copy.skip", source.table.name, err, item)
+				continue
+			}
+			source.err = err
+			return false
+		}
+
+		source.values = values
+		source.count++
+		if source.opts.Progress != nil && source.count%source.opts.Every == 0 {
+			source.opts.Progress(source.count)
+		}
+		return true
+	}
+}
+func (source *postgresCopySource) Values() ([]Any, error) {
+	return source.values, nil
+}
+func (source *postgresCopySource) Err() error {
+	return source.err
+}
+
+// 校验并包装一行数据，按字段顺序返回值
+func (table *PostgresTable) copyRow(columns []string, item Map) ([]Any, error) {
+	value := Map{}
+	errm := infra.Mapping(table.fields, item, value, false, false)
+	if errm.Fail() {
+		return nil, errm
+	}
+
+	newValue := table.base.packing(value)
+	values := make([]Any, len(columns))
+	for i, column := range columns {
+		values[i] = newValue[column]
+	}
+	return values, nil
+}
+
+// 使用COPY FROM STDIN流式导入，next返回false时结束
+// 返回写入的行数，COPY不会执行触发器
+func (table *PostgresTable) Copy(next func() (Map, bool), opts PostgresCopy) (int64, error) {
+	table.base.lastError = nil
+
+	if len(opts.Columns) == 0 {
+		for k := range table.fields {
+			//$count这类不是真实的字段
+			if strings.HasPrefix(k, "$") {
+				continue
+			}
+			if len(table.keys) > 1 || k != table.key {
+				opts.Columns = append(opts.Columns, k)
+			}
+		}
+		sort.Strings(opts.Columns)
+	}
+	if opts.Every <= 0 {
+		opts.Every = 10000
+	}
+
+	source := &postgresCopySource{table: table, opts: opts, next: next}
+
+	var count int64
+	var err error
+	if table.base.connect.setting.Driver == "pgx" {
+		count, err = table.copyPgx(source)
+	} else {
+		count, err = table.copyPq(source)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.Progress != nil && source.count%opts.Every != 0 {
+		opts.Progress(source.count)
+	}
+	if source.skipped > 0 {
+		log.Warning("data.copy.skipped", table.name, source.skipped)
+	}
+
+	return count, nil
+}
+
+// 从channel导入，channel关闭时结束
+func (table *PostgresTable) CopyChan(items <-chan Map, opts PostgresCopy) (int64, error) {
+	ctx := table.base.ctx
+	return table.Copy(func() (Map, bool) {
+		select {
+		case item, ok := <-items:
+			return item, ok
+		case <-ctx.Done():
+			return nil, false
+		}
+	}, opts)
+}
+
+// lib/pq需要在事务中COPY，自动提交模式下单独开启事务
+func (table *PostgresTable) copyPq(source *postgresCopySource) (int64, error) {
+	auto := !table.base.manual
+	if auto {
+		if _, err := table.base.Begin(); err != nil {
+			table.base.errorHandler("data.copy.begin", err, table.name)
+			return 0, table.base.lastError
+		}
+	}
+
+	exec, err := table.base.beginExec()
+	if err != nil {
+		table.base.errorHandler("data.copy.begin", err, table.name)
+		return 0, table.base.lastError
+	}
+
+	stmt, err := exec.PrepareContext(table.base.ctx, pq.CopyInSchema(table.schema, table.view, source.opts.Columns...))
+	if err != nil {
+		table.base.errorHandler("data.copy.prepare", err, table.name)
+		return 0, table.base.lastError
+	}
+	defer stmt.Close()
+
+	for source.Next() {
+		if _, err := stmt.ExecContext(table.base.ctx, source.values...); err != nil {
+			table.base.errorHandler("data.copy.exec", err, table.name, source.count)
+			return 0, table.base.lastError
+		}
+	}
+	if err := source.Err(); err != nil {
+		//回滚事务，已经发送的行都不会写入
+		table.base.errorHandler("data.copy.row", err, table.name, source.count)
+		return 0, table.base.lastError
+	}
+
+	//无参数的Exec结束COPY
+	result, err := stmt.ExecContext(table.base.ctx)
+	if err != nil {
+		table.base.errorHandler("data.copy.flush", err, table.name)
+		return 0, table.base.lastError
+	}
+	count, _ := result.RowsAffected()
+
+	if auto {
+		if err := table.base.Submit(); err != nil {
+			table.base.errorHandler("data.copy.submit", err, table.name)
+			return 0, table.base.lastError
+		}
+	}
+
+	return count, nil
+}
+
+// pgx直接使用原生连接的CopyFrom，数据源出错时会中止COPY
+// database/sql拿不到事务的原生连接，所以pgx不支持在事务中COPY
+func (table *PostgresTable) copyPgx(source *postgresCopySource) (int64, error) {
+	if table.base.manual {
+		//不能用errorHandler，会取消调用方的事务
+		err := errors.New("[数据]pgx驱动不支持在事务中COPY")
+		table.base.lastError = err
+		log.Warning("data.copy.manual", err, table.name)
+		return 0, err
+	}
+
+	ctx := table.base.ctx
+	conn, err := table.base.connect.db.Conn(ctx)
+	if err != nil {
+		table.base.errorHandler("data.copy.conn", err, table.name)
+		return 0, table.base.lastError
+	}
+	defer conn.Close()
+
+	var count int64
+	err = conn.Raw(func(driverConn Any) error {
+		pconn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("[数据]无效的pgx连接")
+		}
+		n, err := pconn.Conn().CopyFrom(ctx, pgx.Identifier{table.schema, table.view}, source.opts.Columns, source)
+		count = n
+		return err
+	})
+	if err != nil {
+		if source.err != nil {
+			err = source.err
+		}
+		table.base.errorHandler("data.copy.exec", err, table.name, source.count)
+		return 0, table.base.lastError
+	}
+
+	return count, nil
+}
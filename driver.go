@@ -1,8 +1,17 @@
 package data_postgres
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	. "github.com/infrago/base"
 	"github.com/infrago/data"
 )
 
@@ -21,6 +30,13 @@ var (
 	}
 )
 
+const (
+	//数据库方言
+	DialectPostgres  = "postgres"
+	DialectCockroach = "cockroach"
+	DialectTimescale = "timescale"
+)
+
 type (
 	PostgresDriver struct{}
 )
@@ -29,17 +45,57 @@ type (
 func (drv *PostgresDriver) Connect(inst *data.Instance) (data.Connect, error) {
 
 	setting := PostgresSetting{
-		Schema: "public",
+		Schema: "public", Driver: "postgres", MaxIdle: -1,
 	}
 
 	if inst.Config.Schema != "" {
 		setting.Schema = inst.Config.Schema
 	}
 
+	//方言要在替换schema之前判断
+	setting.Dialect = dialectOf(inst.Config.Driver, inst.Config.Url)
+	if vv, ok := inst.Setting["dialect"].(string); ok && vv != "" {
+		setting.Dialect = dialectOf(vv, "")
+	}
+
 	//支持自定义的schema，相当于数据库名
-	for _, s := range SCHEMAS {
-		if strings.HasPrefix(inst.Config.Url, s) {
-			inst.Config.Url = strings.Replace(inst.Config.Url, s, "postgres://", 1)
+	inst.Config.Url = schemaUrl(inst.Config.Url)
+
+	//多主机，替换URL中的主机部分
+	switch vv := inst.Setting["hosts"].(type) {
+	case string:
+		for _, host := range strings.Split(vv, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				setting.Hosts = append(setting.Hosts, host)
+			}
+		}
+	case []string:
+		setting.Hosts = append(setting.Hosts, vv...)
+	case []Any:
+		for _, v := range vv {
+			if host, ok := v.(string); ok && host != "" {
+				setting.Hosts = append(setting.Hosts, host)
+			} else {
+				return nil, fmt.Errorf("[数据]无效的hosts设置：%v", v)
+			}
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("[数据]无效的hosts设置：%v", vv)
+	}
+	if len(setting.Hosts) > 0 {
+		if !strings.HasPrefix(inst.Config.Url, "postgres://") {
+			return nil, errors.New("[数据]hosts仅支持URL格式的连接串")
+		}
+		head, _, tail := splitHosts(inst.Config.Url)
+		inst.Config.Url = head + strings.Join(setting.Hosts, ",") + tail
+	}
+	if vv, ok := inst.Setting["target"].(string); ok && vv != "" {
+		switch vv {
+		case "any", "read-write", "read-only", "primary", "standby":
+			setting.Target = vv
+		default:
+			return nil, fmt.Errorf("[数据]无效的target设置：%v", vv)
 		}
 	}
 
@@ -47,7 +103,304 @@ func (drv *PostgresDriver) Connect(inst *data.Instance) (data.Connect, error) {
 		setting.Schema = vv
 	}
 
+	//底层驱动，默认lib/pq
+	if vv, ok := inst.Setting["driver"].(string); ok && vv != "" {
+		switch strings.ToLower(vv) {
+		case "pq", "libpq", "lib/pq", "postgres":
+			setting.Driver = "postgres"
+		case "pgx", "pgx/stdlib":
+			setting.Driver = "pgx"
+		default:
+			return nil, fmt.Errorf("[数据]不支持的driver设置：%v", vv)
+		}
+	}
+
+	//连接池设置
+	if vv, ok := inst.Setting["maxOpen"]; ok {
+		num, err := settingInt(vv)
+		if err != nil || num < 0 {
+			return nil, fmt.Errorf("[数据]无效的maxOpen设置：%v", vv)
+		}
+		setting.MaxOpen = num
+	}
+	if vv, ok := inst.Setting["maxIdle"]; ok {
+		num, err := settingInt(vv)
+		if err != nil || num < 0 {
+			return nil, fmt.Errorf("[数据]无效的maxIdle设置：%v", vv)
+		}
+		setting.MaxIdle = num
+	}
+	if setting.MaxOpen > 0 && setting.MaxIdle > setting.MaxOpen {
+		return nil, errors.New("[数据]maxIdle不能大于maxOpen")
+	}
+	if vv, ok := inst.Setting["lifetime"]; ok {
+		dur, err := settingDuration(vv)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("[数据]无效的lifetime设置：%v", vv)
+		}
+		setting.Lifetime = dur
+	}
+	if vv, ok := inst.Setting["idleTime"]; ok {
+		dur, err := settingDuration(vv)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("[数据]无效的idleTime设置：%v", vv)
+		}
+		setting.IdleTime = dur
+	}
+	if vv, ok := inst.Setting["healthTimeout"]; ok {
+		dur, err := settingDuration(vv)
+		if err != nil || dur < 0 {
+			return nil, fmt.Errorf("[数据]无效的healthTimeout设置：%v", vv)
+		}
+		setting.HealthTimeout = dur
+	}
+
+	//TLS设置，{ mode, ca, cert, key, server }
+	if vv, ok := inst.Setting["tls"].(Map); ok {
+		if mode, ok := vv["mode"].(string); ok {
+			setting.SSLMode = mode
+		}
+		if ca, ok := vv["ca"].(string); ok {
+			setting.SSLCA = ca
+		}
+		if cert, ok := vv["cert"].(string); ok {
+			setting.SSLCert = cert
+		}
+		if key, ok := vv["key"].(string); ok {
+			setting.SSLKey = key
+		}
+		if server, ok := vv["server"].(string); ok {
+			setting.SSLServer = server
+		}
+		if err := checkTLS(setting); err != nil {
+			return nil, err
+		}
+	}
+
+	//会话设置，{ search_path, statementTimeout, lockTimeout, idleTimeout, application }
+	//设置了会话时，search_path默认为schema
+	if vv, ok := inst.Setting["session"].(Map); ok {
+		setting.SearchPath = setting.Schema
+		if path, ok := vv["search_path"].(string); ok && path != "" {
+			setting.SearchPath = path
+		}
+		if app, ok := vv["application"].(string); ok {
+			setting.Application = app
+		}
+		for key, target := range map[string]*time.Duration{
+			"statementTimeout": &setting.StatementTimeout,
+			"lockTimeout":      &setting.LockTimeout,
+			"idleTimeout":      &setting.IdleTimeout,
+		} {
+			if v, ok := vv[key]; ok {
+				dur, err := settingDuration(v)
+				if err != nil || dur < 0 {
+					return nil, fmt.Errorf("[数据]无效的session.%s设置：%v", key, v)
+				}
+				*target = dur
+			}
+		}
+	}
+
+	//自动重试，{ times, backoff, maxBackoff }
+	if vv, ok := inst.Setting["retry"].(Map); ok {
+		setting.RetryTimes = 3
+		setting.RetryBackoff = time.Millisecond * 100
+		setting.RetryMaxBackoff = time.Second * 2
+		if v, ok := vv["times"]; ok {
+			num, err := settingInt(v)
+			if err != nil || num < 0 {
+				return nil, fmt.Errorf("[数据]无效的retry.times设置：%v", v)
+			}
+			setting.RetryTimes = num
+		}
+		if v, ok := vv["backoff"]; ok {
+			dur, err := settingDuration(v)
+			if err != nil || dur < 0 {
+				return nil, fmt.Errorf("[数据]无效的retry.backoff设置：%v", v)
+			}
+			setting.RetryBackoff = dur
+		}
+		if v, ok := vv["maxBackoff"]; ok {
+			dur, err := settingDuration(v)
+			if err != nil || dur < 0 {
+				return nil, fmt.Errorf("[数据]无效的retry.maxBackoff设置：%v", v)
+			}
+			setting.RetryMaxBackoff = dur
+		}
+	}
+
+	//Batch的重试次数，cockroach经常需要重启事务，默认3次
+	if setting.Dialect == DialectCockroach {
+		setting.Retries = 3
+	}
+	if vv, ok := inst.Setting["retries"]; ok {
+		num, err := settingInt(vv)
+		if err != nil || num < 0 {
+			return nil, fmt.Errorf("[数据]无效的retries设置：%v", vv)
+		}
+		setting.Retries = num
+	}
+	if setting.Retries > 0 && setting.RetryBackoff == 0 {
+		setting.RetryBackoff = time.Millisecond * 100
+		setting.RetryMaxBackoff = time.Second * 2
+	}
+
+	//cockroach专用设置
+	if vv, ok := inst.Setting["rowid"].(bool); ok {
+		setting.RowID = vv
+	}
+	switch vv := inst.Setting["follower"].(type) {
+	case bool:
+		if vv {
+			setting.Follower = "follower_read_timestamp()"
+		}
+	case string:
+		if vv != "" {
+			setting.Follower = fmt.Sprintf("'%s'", strings.Replace(vv, "'", "", -1))
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("[数据]无效的follower设置：%v", vv)
+	}
+	if setting.Follower != "" && setting.Dialect != DialectCockroach {
+		return nil, errors.New("[数据]follower仅支持cockroach")
+	}
+
+	//只读副本
+	switch vv := inst.Setting["replicas"].(type) {
+	case string:
+		for _, url := range strings.Split(vv, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				setting.Replicas = append(setting.Replicas, schemaUrl(url))
+			}
+		}
+	case []string:
+		for _, url := range vv {
+			setting.Replicas = append(setting.Replicas, schemaUrl(url))
+		}
+	case []Any:
+		for _, v := range vv {
+			if url, ok := v.(string); ok && url != "" {
+				setting.Replicas = append(setting.Replicas, schemaUrl(url))
+			} else {
+				return nil, fmt.Errorf("[数据]无效的replicas设置：%v", v)
+			}
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("[数据]无效的replicas设置：%v", vv)
+	}
+	setting.ReplicaRetry = time.Second * 30
+	if vv, ok := inst.Setting["replicaRetry"]; ok {
+		dur, err := settingDuration(vv)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("[数据]无效的replicaRetry设置：%v", vv)
+		}
+		setting.ReplicaRetry = dur
+	}
+
 	return &PostgresConnect{
 		instance: inst, setting: setting,
 	}, nil
 }
+
+// 检查TLS设置，证书文件有问题的话，启动时就报错
+func checkTLS(setting PostgresSetting) error {
+	switch setting.SSLMode {
+	case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("[数据]无效的tls.mode设置：%s", setting.SSLMode)
+	}
+
+	if setting.SSLMode == "disable" && (setting.SSLCA != "" || setting.SSLCert != "" || setting.SSLServer != "") {
+		return errors.New("[数据]tls.mode为disable时不能设置证书")
+	}
+
+	if setting.SSLCA != "" {
+		pem, err := os.ReadFile(setting.SSLCA)
+		if err != nil {
+			return fmt.Errorf("[数据]无法读取tls.ca：%v", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return fmt.Errorf("[数据]无效的tls.ca：%s", setting.SSLCA)
+		}
+	}
+
+	if (setting.SSLCert == "") != (setting.SSLKey == "") {
+		return errors.New("[数据]tls.cert和tls.key必须同时设置")
+	}
+	if setting.SSLCert != "" {
+		if _, err := tls.LoadX509KeyPair(setting.SSLCert, setting.SSLKey); err != nil {
+			return fmt.Errorf("[数据]无效的客户端证书：%v", err)
+		}
+	}
+
+	//lib/pq不支持指定服务器名
+	if setting.SSLServer != "" && setting.Driver != "pgx" {
+		return errors.New("[数据]tls.server需要使用pgx驱动")
+	}
+
+	return nil
+}
+
+// 根据驱动名或是URL的schema判断方言
+func dialectOf(name, url string) string {
+	for _, s := range []string{name, strings.SplitN(url, "://", 2)[0]} {
+		switch strings.ToLower(s) {
+		case "cockroachdb", "cockroach", "crdb":
+			return DialectCockroach
+		case "timescaledb", "timescale", "tsdb":
+			return DialectTimescale
+		}
+	}
+	return DialectPostgres
+}
+
+// 把自定义的schema统一换成postgres://
+func schemaUrl(url string) string {
+	for _, s := range SCHEMAS {
+		if strings.HasPrefix(url, s) {
+			return strings.Replace(url, s, "postgres://", 1)
+		}
+	}
+	return url
+}
+
+// 解析整数设置，配置文件中的数字可能是各种类型
+func settingInt(value Any) (int, error) {
+	switch vv := value.(type) {
+	case int:
+		return vv, nil
+	case int32:
+		return int(vv), nil
+	case int64:
+		return int(vv), nil
+	case float64:
+		//不是整数的直接报错，不能截断
+		if vv != math.Trunc(vv) {
+			return 0, fmt.Errorf("无效的整数：%v", value)
+		}
+		return int(vv), nil
+	case string:
+		return strconv.Atoi(vv)
+	}
+	return 0, fmt.Errorf("无效的数值：%v", value)
+}
+
+// 解析时长设置，数字表示秒，字串按"30s"、"5m"格式解析
+func settingDuration(value Any) (time.Duration, error) {
+	switch vv := value.(type) {
+	case time.Duration:
+		return vv, nil
+	case int:
+		return time.Second * time.Duration(vv), nil
+	case int64:
+		return time.Second * time.Duration(vv), nil
+	case float64:
+		return time.Duration(vv * float64(time.Second)), nil
+	case string:
+		return time.ParseDuration(vv)
+	}
+	return 0, fmt.Errorf("无效的时长：%v", value)
+}
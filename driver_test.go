@@ -0,0 +1,76 @@
+package data_postgres
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+func TestSettingInt(t *testing.T) {
+	tests := []struct {
+		value Any
+		want  int
+		fail  bool
+	}{
+		{10, 10, false},
+		{int32(10), 10, false},
+		{int64(10), 10, false},
+		{float64(10), 10, false},
+		{float64(0), 0, false},
+		{float64(-1), -1, false},
+		{"10", 10, false},
+		{"-1", -1, false},
+		{float64(1.5), 0, true},
+		{"1.5", 0, true},
+		{"abc", 0, true},
+		{true, 0, true},
+		{nil, 0, true},
+	}
+
+	for _, test := range tests {
+		value, err := settingInt(test.value)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%#v应该报错，得到%d", test.value, value)
+			}
+			continue
+		}
+		if err != nil || value != test.want {
+			t.Errorf("%#v：%d %v，应为%d", test.value, value, err, test.want)
+		}
+	}
+}
+
+func TestSettingDuration(t *testing.T) {
+	tests := []struct {
+		value Any
+		want  time.Duration
+		fail  bool
+	}{
+		{time.Minute, time.Minute, false},
+		{30, time.Second * 30, false},
+		{int64(30), time.Second * 30, false},
+		{float64(1.5), time.Millisecond * 1500, false},
+		{"30s", time.Second * 30, false},
+		{"5m", time.Minute * 5, false},
+		{"100ms", time.Millisecond * 100, false},
+		{"30", 0, true},
+		{"abc", 0, true},
+		{true, 0, true},
+		{nil, 0, true},
+	}
+
+	for _, test := range tests {
+		value, err := settingDuration(test.value)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%#v应该报错，得到%v", test.value, value)
+			}
+			continue
+		}
+		if err != nil || value != test.want {
+			t.Errorf("%#v：%v %v，应为%v", test.value, value, err, test.want)
+		}
+	}
+}
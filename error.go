@@ -0,0 +1,186 @@
+package data_postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+var (
+	//context超时或取消，可以用errors.Is判断
+	ErrTimeout  = errors.New("[数据]操作超时")
+	ErrCanceled = errors.New("[数据]操作已取消")
+
+	//按SQLSTATE分类的错误，可以用errors.Is判断
+	//需要约束名和字段时，用errors.As取出*PostgresError
+	ErrUnique        = errors.New("[数据]唯一约束冲突")
+	ErrForeignKey    = errors.New("[数据]外键约束冲突")
+	ErrNotNull       = errors.New("[数据]非空约束冲突")
+	ErrCheck         = errors.New("[数据]检查约束冲突")
+	ErrSerialization = errors.New("[数据]序列化失败")
+	ErrDeadlock      = errors.New("[数据]死锁")
+	ErrLocked        = errors.New("[数据]记录已被锁定")
+	ErrConnection    = errors.New("[数据]连接已断开")
+)
+
+type (
+	//分类后的数据库错误
+	//Kind为上面的分类错误，Err为驱动返回的原始错误
+	PostgresError struct {
+		Kind       error
+		Code       string
+		Table      string
+		Constraint string
+		Column     string
+		Detail     string
+		Err        error
+	}
+)
+
+func (err *PostgresError) Error() string {
+	if err.Constraint != "" {
+		return fmt.Sprintf("%v(%s): %v", err.Kind, err.Constraint, err.Err)
+	}
+	return fmt.Sprintf("%v: %v", err.Kind, err.Err)
+}
+
+// errors.Is(err, ErrUnique)等判断分类
+func (err *PostgresError) Is(target error) bool {
+	return err.Kind == target
+}
+
+// errors.As依然可以取到*pq.Error或*pgconn.PgError
+func (err *PostgresError) Unwrap() error {
+	return err.Err
+}
+
+// 获取错误的SQLSTATE，兼容lib/pq和pgx
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// 把错误分类包装，无法分类的原样返回
+// ctx已经超时或取消的，也按超时和取消处理
+func classify(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	//已经分类过的
+	var pgErr *PostgresError
+	if errors.As(err, &pgErr) {
+		return err
+	}
+
+	perr := &PostgresError{Code: sqlState(err), Err: err}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded:
+		perr.Kind = ErrTimeout
+	case errors.Is(err, context.Canceled) || ctx.Err() == context.Canceled:
+		perr.Kind = ErrCanceled
+	case perr.Code == "23505":
+		perr.Kind = ErrUnique
+	case perr.Code == "23503":
+		perr.Kind = ErrForeignKey
+	case perr.Code == "23502":
+		perr.Kind = ErrNotNull
+	case perr.Code == "23514":
+		perr.Kind = ErrCheck
+	case perr.Code == "40001":
+		perr.Kind = ErrSerialization
+	case perr.Code == "40P01":
+		perr.Kind = ErrDeadlock
+	case perr.Code == "55P03":
+		//NOWAIT或lock_timeout拿不到锁
+		perr.Kind = ErrLocked
+	case perr.Code == "57014":
+		//语句超时
+		perr.Kind = ErrTimeout
+	case connError(err):
+		perr.Kind = ErrConnection
+	default:
+		return err
+	}
+
+	//约束和字段信息
+	var pqErr *pq.Error
+	var pgxErr *pgconn.PgError
+	if errors.As(err, &pqErr) {
+		perr.Table, perr.Constraint, perr.Column, perr.Detail = pqErr.Table, pqErr.Constraint, pqErr.Column, pqErr.Detail
+	} else if errors.As(err, &pgxErr) {
+		perr.Table, perr.Constraint, perr.Column, perr.Detail = pgxErr.TableName, pgxErr.ConstraintName, pgxErr.ColumnName, pgxErr.Detail
+	}
+
+	//唯一约束不带字段，从 Key (field)=(value) already exists. 中取
+	if perr.Column == "" && (perr.Kind == ErrUnique || perr.Kind == ErrForeignKey) {
+		perr.Column = detailColumn(perr.Detail)
+	}
+
+	return perr
+}
+
+// 从错误详情中取出字段，多个字段时为 a, b
+func detailColumn(detail string) string {
+	start := strings.Index(detail, "Key (")
+	if start < 0 {
+		return ""
+	}
+	detail = detail[start+5:]
+	end := strings.Index(detail, ")=(")
+	if end < 0 {
+		return ""
+	}
+	return detail[:end]
+}
+
+// 是否需要重启整个事务，40001序列化失败，40P01死锁
+func restartable(err error) bool {
+	switch sqlState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+// 是否连接类错误
+func connError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	//08xxx连接异常，57P01-57P03服务关闭或不可用
+	code := sqlState(err)
+	switch {
+	case strings.HasPrefix(code, "08"):
+		return true
+	case code == "57P01", code == "57P02", code == "57P03":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,143 @@
+package data_postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+func TestClassify(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		kind error
+		code string
+	}{
+		{"pq唯一", context.Background(), &pq.Error{Code: "23505"}, ErrUnique, "23505"},
+		{"pgx唯一", context.Background(), &pgconn.PgError{Code: "23505"}, ErrUnique, "23505"},
+		{"外键", context.Background(), &pq.Error{Code: "23503"}, ErrForeignKey, "23503"},
+		{"非空", context.Background(), &pgconn.PgError{Code: "23502"}, ErrNotNull, "23502"},
+		{"检查", context.Background(), &pq.Error{Code: "23514"}, ErrCheck, "23514"},
+		{"序列化", context.Background(), &pq.Error{Code: "40001"}, ErrSerialization, "40001"},
+		{"死锁", context.Background(), &pgconn.PgError{Code: "40P01"}, ErrDeadlock, "40P01"},
+		{"锁定", context.Background(), &pq.Error{Code: "55P03"}, ErrLocked, "55P03"},
+		{"语句超时", context.Background(), &pgconn.PgError{Code: "57014"}, ErrTimeout, "57014"},
+		{"连接异常", context.Background(), &pq.Error{Code: "08006"}, ErrConnection, "08006"},
+		{"服务关闭", context.Background(), &pgconn.PgError{Code: "57P01"}, ErrConnection, "57P01"},
+		{"EOF", context.Background(), io.EOF, ErrConnection, ""},
+		{"context超时", context.Background(), fmt.Errorf("query: %w", context.DeadlineExceeded), ErrTimeout, ""},
+		{"context取消", canceled, errors.New("canceled"), ErrCanceled, ""},
+		{"包装过的", context.Background(), fmt.Errorf("exec: %w", &pq.Error{Code: "23505"}), ErrUnique, "23505"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := classify(test.ctx, test.err)
+			if !errors.Is(err, test.kind) {
+				t.Fatalf("分类错误：%v，应为%v", err, test.kind)
+			}
+
+			var perr *PostgresError
+			if !errors.As(err, &perr) {
+				t.Fatalf("不是*PostgresError：%T", err)
+			}
+			if perr.Code != test.code {
+				t.Fatalf("SQLSTATE错误：%q，应为%q", perr.Code, test.code)
+			}
+			if !errors.Is(err, test.err) {
+				t.Fatalf("拿不到原始错误：%v", err)
+			}
+		})
+	}
+}
+
+func TestClassifyUnknown(t *testing.T) {
+	if err := classify(context.Background(), nil); err != nil {
+		t.Fatalf("nil应返回nil：%v", err)
+	}
+
+	//无法分类的原样返回
+	for _, raw := range []error{errors.New("unknown"), &pq.Error{Code: "42P01"}, &pgconn.PgError{Code: "22P02"}} {
+		if err := classify(context.Background(), raw); err != raw {
+			t.Fatalf("无法分类的应原样返回：%v", err)
+		}
+	}
+
+	//已经分类过的不再包装
+	once := classify(context.Background(), &pq.Error{Code: "23505"})
+	if err := classify(context.Background(), once); err != once {
+		t.Fatalf("重复分类：%v", err)
+	}
+}
+
+func TestClassifyDetail(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		table      string
+		constraint string
+		column     string
+	}{
+		{
+			"pq唯一", &pq.Error{Code: "23505", Table: "user", Constraint: "user_email_key", Detail: "Key (email)=(a@b.c) already exists."},
+			"user", "user_email_key", "email",
+		},
+		{
+			"pgx联合唯一", &pgconn.PgError{Code: "23505", TableName: "member", ConstraintName: "member_pkey", Detail: "Key (tenant, id)=(1, 2) already exists."},
+			"member", "member_pkey", "tenant, id",
+		},
+		{
+			"外键", &pq.Error{Code: "23503", Table: "order", Constraint: "order_user_fkey", Detail: `Key (user)=(9) is not present in table "user".`},
+			"order", "order_user_fkey", "user",
+		},
+		{
+			"非空带字段", &pgconn.PgError{Code: "23502", TableName: "user", ColumnName: "name"},
+			"user", "", "name",
+		},
+		{
+			"非空不从详情取字段", &pq.Error{Code: "23502", Table: "user", Detail: "Key (name)=(x)"},
+			"user", "", "",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var perr *PostgresError
+			if !errors.As(classify(context.Background(), test.err), &perr) {
+				t.Fatal("不是*PostgresError")
+			}
+			if perr.Table != test.table || perr.Constraint != test.constraint || perr.Column != test.column {
+				t.Fatalf("约束信息错误：%q %q %q", perr.Table, perr.Constraint, perr.Column)
+			}
+		})
+	}
+}
+
+func TestDetailColumn(t *testing.T) {
+	tests := []struct {
+		detail string
+		column string
+	}{
+		{"Key (email)=(a@b.c) already exists.", "email"},
+		{"Key (tenant, id)=(1, 2) already exists.", "tenant, id"},
+		{"Key (lower(email::text))=(a@b.c) already exists.", "lower(email::text)"},
+		{"Failing row contains (1, null).", ""},
+		{"Key (email", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if column := detailColumn(test.detail); column != test.column {
+			t.Errorf("%q：%q，应为%q", test.detail, column, test.column)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package data_postgres
 
 import (
+	"context"
 	"database/sql"
 
 	. "github.com/infrago/base"
@@ -12,5 +13,11 @@ type (
 		Prepare(query string) (*sql.Stmt, error)
 		Query(query string, args ...Any) (*sql.Rows, error)
 		QueryRow(query string, args ...Any) *sql.Row
+
+		//带context的版本，取消和超时会传到数据库
+		ExecContext(ctx context.Context, query string, args ...Any) (sql.Result, error)
+		PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+		QueryContext(ctx context.Context, query string, args ...Any) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...Any) *sql.Row
 	}
 )
@@ -0,0 +1,60 @@
+package data_postgres
+
+import (
+	"fmt"
+	"sync"
+)
+
+// 派生一个新的base，共享连接和context
+// 事务、触发器、锁和错误都是独立的，可以交给另一个goroutine使用
+// base本身不是并发安全的，多个goroutine需要各自Fork，用完Close
+// 派生出来的base不在原来的事务中，读不到事务里未提交的数据
+func (base *PostgresBase) Fork() *PostgresBase {
+	base.connect.mutex.Lock()
+	base.connect.actives++
+	base.connect.mutex.Unlock()
+
+	return &PostgresBase{
+		connect: base.connect, name: base.name, schema: base.schema,
+		ctx: base.ctx, triggers: []postgresTrigger{},
+	}
+}
+
+// 并行执行，每个job使用自己的Fork，执行完自动Close
+// job返回的错误，或是job里操作留下的Erred()，作为这个job的错误
+// 全部执行完后，按job的顺序返回第一个错误
+func (base *PostgresBase) Parallel(jobs ...func(*PostgresBase) error) error {
+	errs := make([]error, len(jobs))
+
+	wg := sync.WaitGroup{}
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job func(*PostgresBase) error) {
+			defer wg.Done()
+
+			fork := base.Fork()
+			defer fork.Close()
+
+			//job里的panic不能带崩整个进程
+			defer func() {
+				if r := recover(); r != nil {
+					errs[i] = fmt.Errorf("[数据]并行执行失败：%v", r)
+				}
+			}()
+
+			err := job(fork)
+			if ferr := fork.Erred(); err == nil {
+				err = ferr
+			}
+			errs[i] = err
+		}(i, job)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
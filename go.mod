@@ -1,6 +1,15 @@
 module github.com/infrago/data-postgres
 
-go 1.18
-
-
-
+go 1.21
+
+require (
+	github.com/jackc/pgx/v5 v5.7.1
+	github.com/lib/pq v1.12.3
+)
+
+require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
+	golang.org/x/crypto v0.27.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+)
@@ -3,7 +3,8 @@ package data_postgres
 import (
 	"github.com/infrago/data"
 	"github.com/infrago/infra"
-	_ "github.com/lib/pq" //此包自动注册名为postgres的sql驱动
+	_ "github.com/jackc/pgx/v5/stdlib" //此包自动注册名为pgx的sql驱动
+	_ "github.com/lib/pq"              //此包自动注册名为postgres的sql驱动
 )
 
 var (
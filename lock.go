@@ -0,0 +1,209 @@
+package data_postgres
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	. "github.com/infrago/base"
+)
+
+type (
+	//行锁，作为First/Query/Range的参数传入
+	PostgresLock string
+)
+
+const (
+	ForUpdate      PostgresLock = "FOR UPDATE"
+	ForNoKeyUpdate PostgresLock = "FOR NO KEY UPDATE"
+	ForShare       PostgresLock = "FOR SHARE"
+	ForKeyShare    PostgresLock = "FOR KEY SHARE"
+)
+
+// 拿不到锁时直接报错
+func (lock PostgresLock) NoWait() PostgresLock {
+	return lock + " NOWAIT"
+}
+
+// 跳过已经被锁的行
+func (lock PostgresLock) SkipLocked() PostgresLock {
+	return lock + " SKIP LOCKED"
+}
+
+// 把锁的key转成bigint，字串使用FNV-1a哈希
+func lockKey(key Any) (int64, error) {
+	switch vv := key.(type) {
+	case int64:
+		return vv, nil
+	case int:
+		return int64(vv), nil
+	case int32:
+		return int64(vv), nil
+	case string:
+		hash := fnv.New64a()
+		hash.Write([]byte(vv))
+		return int64(hash.Sum64()), nil
+	}
+	return 0, fmt.Errorf("[数据]无效的锁：%v", key)
+}
+
+// 检查是否支持咨询锁，并转换锁的key
+// cockroach不支持咨询锁
+func (base *PostgresBase) advisoryKey(key Any) (int64, error) {
+	if base.connect.setting.Dialect == DialectCockroach {
+		return 0, errors.New("[数据]cockroach不支持咨询锁")
+	}
+	return lockKey(key)
+}
+
+// 会话级锁使用的连接，同一个base的会话锁都在这个连接上
+func (base *PostgresBase) lockConn() (*sql.Conn, error) {
+	if base.lockconn != nil {
+		return base.lockconn, nil
+	}
+	conn, err := base.connect.db.Conn(base.ctx)
+	if err != nil {
+		return nil, err
+	}
+	base.lockconn = conn
+	base.locks = map[int64]int{}
+	return conn, nil
+}
+
+// 会话锁都释放后，把连接还给连接池
+func (base *PostgresBase) lockDone() {
+	if base.lockconn != nil && len(base.locks) == 0 {
+		base.lockconn.Close()
+		base.lockconn = nil
+	}
+}
+
+// 会话级锁，阻塞直到拿到锁，需要调用Unlock释放
+// 同一个key可以重复加锁，需要同样次数的Unlock
+func (base *PostgresBase) Lock(key Any) error {
+	ok, err := base.sessionLock(key, `SELECT true FROM pg_advisory_lock($1)`)
+	if err == nil && !ok {
+		err = errors.New("[数据]加锁失败")
+	}
+	return err
+}
+
+// 会话级锁，拿不到锁时直接返回false
+func (base *PostgresBase) TryLock(key Any) (bool, error) {
+	return base.sessionLock(key, `SELECT pg_try_advisory_lock($1)`)
+}
+
+func (base *PostgresBase) sessionLock(key Any, sql string) (bool, error) {
+	base.lastError = nil
+
+	id, err := base.advisoryKey(key)
+	if err != nil {
+		base.lastError = err
+		return false, err
+	}
+
+	conn, err := base.lockConn()
+	if err != nil {
+		base.lastError = err
+		return false, err
+	}
+
+	ok := false
+	err = conn.QueryRowContext(base.ctx, sql, id).Scan(&ok)
+	if err == nil && ok {
+		base.locks[id]++
+	}
+	base.lockDone()
+
+	if err != nil {
+		base.lastError = classify(base.ctx, err)
+		return false, base.lastError
+	}
+	return ok, nil
+}
+
+// 释放会话级锁
+func (base *PostgresBase) Unlock(key Any) error {
+	base.lastError = nil
+
+	id, err := base.advisoryKey(key)
+	if err != nil {
+		base.lastError = err
+		return err
+	}
+	if base.locks[id] <= 0 || base.lockconn == nil {
+		err := errors.New("[数据]没有持有这个锁")
+		base.lastError = err
+		return err
+	}
+
+	ok := false
+	err = base.lockconn.QueryRowContext(base.ctx, `SELECT pg_advisory_unlock($1)`, id).Scan(&ok)
+	if err != nil {
+		base.lastError = classify(base.ctx, err)
+		return base.lastError
+	}
+
+	if base.locks[id]--; base.locks[id] <= 0 {
+		delete(base.locks, id)
+	}
+	base.lockDone()
+
+	return nil
+}
+
+// 释放全部会话级锁，base关闭时调用
+func (base *PostgresBase) unlockAll() {
+	if base.lockconn == nil {
+		return
+	}
+	//context可能已经取消，这里不能用base.ctx
+	_, err := base.lockconn.ExecContext(context.Background(), `SELECT pg_advisory_unlock_all()`)
+	if err != nil {
+		//释放失败的连接不能回到连接池，直接丢弃
+		base.lockconn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	base.locks = map[int64]int{}
+	base.lockDone()
+}
+
+// 事务级锁，阻塞直到拿到锁，Submit或Cancel时自动释放
+// 需要在Begin之后调用
+func (base *PostgresBase) LockTx(key Any) error {
+	_, err := base.txLock(key, `SELECT true FROM pg_advisory_xact_lock($1)`)
+	return err
+}
+
+// 事务级锁，拿不到锁时直接返回false
+func (base *PostgresBase) TryLockTx(key Any) (bool, error) {
+	return base.txLock(key, `SELECT pg_try_advisory_xact_lock($1)`)
+}
+
+func (base *PostgresBase) txLock(key Any, sql string) (bool, error) {
+	base.lastError = nil
+
+	//先检查，不能用errorHandler，会取消调用方的事务
+	id, err := base.advisoryKey(key)
+	if err != nil {
+		base.lastError = err
+		return false, err
+	}
+
+	if base.tx == nil {
+		err := errors.New("[数据]事务级锁需要先开启事务")
+		base.lastError = err
+		return false, err
+	}
+
+	ok := false
+	err = base.tx.QueryRowContext(base.ctx, sql, id).Scan(&ok)
+	if err != nil {
+		base.errorHandler("data.lock.query", err, base.name, key)
+		return false, base.lastError
+	}
+
+	return ok, nil
+}
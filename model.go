@@ -31,7 +31,7 @@ func (model *PostgresModel) First(args ...Any) Map {
 		return nil
 	}
 
-	exec, err := model.base.beginExec()
+	exec, err := model.base.readExec()
 	if err != nil {
 		model.base.errorHandler("model.first.begin", err, model.name)
 		return nil
@@ -46,7 +46,7 @@ func (model *PostgresModel) First(args ...Any) Map {
 	}
 
 	sql := fmt.Sprintf(`%s %s`, where, orderby)
-	row := exec.QueryRow(sql, builds...)
+	row := exec.QueryRowContext(model.base.ctx, sql, builds...)
 	if row == nil {
 		model.base.errorHandler("model.first.query", err, model.name, sql)
 		return nil
@@ -91,14 +91,14 @@ func (model *PostgresModel) Query(args ...Any) []Map {
 		return []Map{}
 	}
 
-	exec, err := model.base.beginExec()
+	exec, err := model.base.readExec()
 	if err != nil {
 		model.base.errorHandler("model.query.begin", err, model.name)
 		return []Map{}
 	}
 
 	sql := fmt.Sprintf(`%s %s`, where, orderby)
-	rows, err := exec.Query(sql, builds...)
+	rows, err := exec.QueryContext(model.base.ctx, sql, builds...)
 	if err != nil {
 		model.base.errorHandler("model.query.query", err, model.name, sql, builds)
 		return []Map{}
@@ -168,14 +168,14 @@ func (model *PostgresModel) LimitRange(limit int64, next data.RangeFunc, args ..
 		return infra.Fail
 	}
 
-	exec, err := model.base.beginExec()
+	exec, err := model.base.readExec()
 	if err != nil {
 		model.base.errorHandler("model.range.begin", err, model.name)
 		return infra.Fail
 	}
 
 	sql := fmt.Sprintf(`%s %s`, where, orderby)
-	rows, err := exec.Query(sql, builds...)
+	rows, err := exec.QueryContext(model.base.ctx, sql, builds...)
 	if err != nil {
 		model.base.errorHandler("model.range.query", err, model.name, sql, builds)
 		return infra.Fail
@@ -0,0 +1,108 @@
+package data_postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/infrago/base"
+	"github.com/infrago/log"
+)
+
+type (
+	//只读副本
+	//出现连接类错误时，暂停使用一段时间，到期后自动恢复轮询
+	postgresReplica struct {
+		connect *PostgresConnect
+		url     string
+		db      *sql.DB
+		failed  int64 //失败时间，UnixNano，0表示正常
+	}
+)
+
+// 副本是否可用
+func (replica *postgresReplica) healthy() bool {
+	failed := atomic.LoadInt64(&replica.failed)
+	if failed == 0 {
+		return true
+	}
+	return time.Since(time.Unix(0, failed)) >= replica.connect.setting.ReplicaRetry
+}
+
+// 根据错误判断副本是否失效
+func (replica *postgresReplica) check(err error) {
+	if err == nil {
+		atomic.StoreInt64(&replica.failed, 0)
+		return
+	}
+	if connError(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		atomic.StoreInt64(&replica.failed, time.Now().UnixNano())
+		log.Warning("data.replica.failed", replica.connect.instance.Name, err)
+	}
+}
+
+func (replica *postgresReplica) Exec(query string, args ...Any) (sql.Result, error) {
+	return replica.ExecContext(context.Background(), query, args...)
+}
+func (replica *postgresReplica) Prepare(query string) (*sql.Stmt, error) {
+	return replica.PrepareContext(context.Background(), query)
+}
+func (replica *postgresReplica) Query(query string, args ...Any) (*sql.Rows, error) {
+	return replica.QueryContext(context.Background(), query, args...)
+}
+func (replica *postgresReplica) QueryRow(query string, args ...Any) *sql.Row {
+	return replica.QueryRowContext(context.Background(), query, args...)
+}
+func (replica *postgresReplica) ExecContext(ctx context.Context, query string, args ...Any) (sql.Result, error) {
+	result, err := replica.db.ExecContext(ctx, query, args...)
+	replica.check(err)
+	return result, err
+}
+func (replica *postgresReplica) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, err := replica.db.PrepareContext(ctx, query)
+	replica.check(err)
+	return stmt, err
+}
+func (replica *postgresReplica) QueryContext(ctx context.Context, query string, args ...Any) (*sql.Rows, error) {
+	rows, err := replica.db.QueryContext(ctx, query, args...)
+	replica.check(err)
+	return rows, err
+}
+func (replica *postgresReplica) QueryRowContext(ctx context.Context, query string, args ...Any) *sql.Row {
+	row := replica.db.QueryRowContext(ctx, query, args...)
+	replica.check(row.Err())
+	return row
+}
+
+// 读操作的执行器，优先副本，没有可用副本时用主库
+func (this *PostgresConnect) reader() PostgresExecutor {
+	if replica := this.replica(); replica != nil {
+		return replica
+	}
+	return this.db
+}
+
+// 写操作的执行器
+func (this *PostgresConnect) writer() PostgresExecutor {
+	return this.db
+}
+
+// 轮询选择一个可用的副本，没有可用副本时返回nil
+func (this *PostgresConnect) replica() *postgresReplica {
+	count := len(this.replicas)
+	if count == 0 {
+		return nil
+	}
+
+	start := atomic.AddUint64(&this.cursor, 1)
+	for i := 0; i < count; i++ {
+		replica := this.replicas[(start+uint64(i))%uint64(count)]
+		if replica.healthy() {
+			return replica
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package data_postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/infrago/base"
+	"github.com/infrago/log"
+)
+
+type (
+	//自动提交模式下的重试执行器
+	//读操作遇到连接类错误时重试，写操作只在确定语句未执行时重试
+	//current为当前使用的执行器，同一个操作的多条语句使用同一个副本，重试时才重新选择
+	postgresRetry struct {
+		connect *PostgresConnect
+		read    bool
+		exec    func() PostgresExecutor
+		current PostgresExecutor
+	}
+)
+
+// 获取执行器，第一次或重试时重新选择
+func (retry *postgresRetry) executor(i int) PostgresExecutor {
+	if retry.current == nil || i > 0 {
+		retry.current = retry.exec()
+	}
+	return retry.current
+}
+
+// 是否需要重试，需要时会等待并记录
+// context结束时不再重试
+func (retry *postgresRetry) retry(ctx context.Context, i int, err error, query string) bool {
+	if err == nil || i >= retry.connect.setting.RetryTimes || ctx.Err() != nil {
+		return false
+	}
+	if !notExecuted(err) && !(retry.read && connError(err)) {
+		return false
+	}
+
+	atomic.AddInt64(&retry.connect.retries, 1)
+	log.Warning("data.retry", retry.connect.instance.Name, i+1, err, query)
+
+	timer := time.NewTimer(backoff(retry.connect.setting.RetryBackoff, retry.connect.setting.RetryMaxBackoff, i))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (retry *postgresRetry) Exec(query string, args ...Any) (sql.Result, error) {
+	return retry.ExecContext(context.Background(), query, args...)
+}
+func (retry *postgresRetry) Prepare(query string) (*sql.Stmt, error) {
+	return retry.PrepareContext(context.Background(), query)
+}
+func (retry *postgresRetry) Query(query string, args ...Any) (*sql.Rows, error) {
+	return retry.QueryContext(context.Background(), query, args...)
+}
+func (retry *postgresRetry) QueryRow(query string, args ...Any) *sql.Row {
+	return retry.QueryRowContext(context.Background(), query, args...)
+}
+func (retry *postgresRetry) ExecContext(ctx context.Context, query string, args ...Any) (sql.Result, error) {
+	for i := 0; ; i++ {
+		result, err := retry.executor(i).ExecContext(ctx, query, args...)
+		if !retry.retry(ctx, i, err, query) {
+			return result, err
+		}
+	}
+}
+func (retry *postgresRetry) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return retry.executor(0).PrepareContext(ctx, query)
+}
+func (retry *postgresRetry) QueryContext(ctx context.Context, query string, args ...Any) (*sql.Rows, error) {
+	for i := 0; ; i++ {
+		rows, err := retry.executor(i).QueryContext(ctx, query, args...)
+		if !retry.retry(ctx, i, err, query) {
+			return rows, err
+		}
+	}
+}
+func (retry *postgresRetry) QueryRowContext(ctx context.Context, query string, args ...Any) *sql.Row {
+	for i := 0; ; i++ {
+		row := retry.executor(i).QueryRowContext(ctx, query, args...)
+		if !retry.retry(ctx, i, row.Err(), query) {
+			return row
+		}
+	}
+}
+
+// 第几次重试的等待时间，指数退避
+func backoff(delay, max time.Duration, i int) time.Duration {
+	delay = delay << uint(i)
+	if max > 0 && (delay > max || delay <= 0) {
+		delay = max
+	}
+	return delay
+}
+
+// 确定语句没有被执行的错误，写操作也可以安全重试
+func notExecuted(err error) bool {
+	//连接都没建立
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+
+	//08001无法建立连接，08004服务器拒绝连接
+	//53300连接数已满，57P03服务暂不可用
+	switch sqlState(err) {
+	case "08001", "08004", "53300", "57P03":
+		return true
+	}
+
+	return false
+}
@@ -3,6 +3,7 @@ package data_postgres
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -11,9 +12,29 @@ import (
 	"github.com/infrago/infra"
 )
 
+const (
+	//单条语句的参数上限
+	postgresMaxParams = 65535
+)
+
 type (
 	PostgresTable struct {
 		PostgresView
+
+		//timescale超表设置，来自表配置的hypertable
+		hypertable *PostgresHypertable
+	}
+
+	//Upsert选项
+	PostgresUpsert struct {
+		//冲突判断的字段，需要有唯一索引，默认为主键
+		Conflict []string
+		//冲突时覆盖的字段，默认为冲突字段以外的全部字段
+		Update []string
+		//冲突时累加的字段，新值加到原值上
+		Increment []string
+		//冲突时不做修改，直接返回已有的行
+		Nothing bool
 	}
 )
 
@@ -38,7 +59,7 @@ func (table *PostgresTable) Create(dddd Map) Map {
 	keys, tags, vals := []string{}, []string{}, make([]interface{}, 0)
 	i := 1
 	for k, v := range newValue {
-		if k == table.key {
+		if table.isKey(k) {
 			if v == nil {
 				continue
 			}
@@ -57,32 +78,207 @@ func (table *PostgresTable) Create(dddd Map) Map {
 		return nil
 	}
 
-	sql := fmt.Sprintf(`INSERT INTO "%s"."%s" ("%s") VALUES (%s) RETURNING "%s";`, table.schema, table.view, strings.Join(keys, `","`), strings.Join(tags, `,`), table.key)
-	row := exec.QueryRow(sql, vals...)
-	if row == nil {
-		table.base.errorHandler("data.create.queryrow", errors.New("无返回行"), table.name)
+	//返回整行，包括数据库默认值、生成列和触发器设置的字段
+	sql := fmt.Sprintf(`INSERT INTO "%s"."%s" ("%s") VALUES (%s) RETURNING *;`, table.schema, table.view, strings.Join(keys, `","`), strings.Join(tags, `,`))
+	rows, err := exec.QueryContext(table.base.ctx, sql, vals...) //QueryRow不支持获取字段列表
+	if err != nil {
+		table.base.errorHandler("data.create.query", err, table.name, sql)
+		return nil
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		table.base.errorHandler("data.create.columns", err, table.name, sql)
+		return nil
+	}
+
+	if !rows.Next() {
+		err := rows.Err()
+		if err == nil {
+			err = errors.New("无返回行")
+		}
+		table.base.errorHandler("data.create.next", err, table.name, sql)
 		return nil
 	}
 
-	id := int64(0)
-	err = row.Scan(&id)
+	//扫描数据
+	values := make([]interface{}, len(columns))  //真正的值
+	pValues := make([]interface{}, len(columns)) //指针，指向值
+	for i := range values {
+		pValues[i] = &values[i]
+	}
+	err = rows.Scan(pValues...)
 	if err != nil {
 		table.base.errorHandler("data.create.scan", err, table.name, sql)
 		return nil
 	}
-	value[table.key] = id
+
+	//解包后按字段生成
+	m := table.base.unpacking(columns, values)
+	item := Map{}
+	errm = infra.Mapping(table.fields, m, item, false, true)
+	if errm.Fail() {
+		table.base.errorHandler("data.create.mapping", errm, table.name)
+		return nil
+	}
 
 	//触发器
-	table.base.trigger(data.CreateTrigger, Map{"base": table.base.name, "table": table.name, "entity": value, table.key: value[table.key]})
+	table.base.trigger(data.CreateTrigger, Map{"base": table.base.name, "table": table.name, "entity": item, table.key: item[table.key]})
 
-	return value
+	return item
+}
+
+// 批量创建对象，使用多行VALUES写入
+// 超过参数上限时分批写入，自动提交模式下会包在一个事务中
+func (table *PostgresTable) Creates(items []Map) []Map {
+	table.base.lastError = nil
+
+	if len(items) == 0 {
+		return []Map{}
+	}
+
+	//按字段生成值，全部校验通过才写入
+	values, newValues := make([]Map, 0, len(items)), make([]Map, 0, len(items))
+	columns := map[string]bool{}
+	for i, item := range items {
+		value := Map{}
+		errm := infra.Mapping(table.fields, item, value, false, false)
+		if errm.Fail() {
+			table.base.errorHandler("data.creates.parse", errm, errm.Args, table.name, i, value)
+			return nil
+		}
+
+		newValue := table.base.packing(value)
+		for k, v := range newValue {
+			//id为空的时候使用默认值
+			if table.isKey(k) && v == nil {
+				delete(newValue, k)
+				continue
+			}
+			columns[k] = true
+		}
+
+		values = append(values, value)
+		newValues = append(newValues, newValue)
+	}
+
+	keys := []string{}
+	for k := range columns {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	//每批的行数，postgres单条语句最多65535个参数
+	size := len(items)
+	if len(keys) > 0 && size > postgresMaxParams/len(keys) {
+		size = postgresMaxParams / len(keys)
+	}
+
+	//分多批时开启事务，要么全部成功，要么全部失败
+	auto := !table.base.manual && size < len(items)
+	if auto {
+		if _, err := table.base.Begin(); err != nil {
+			table.base.errorHandler("data.creates.begin", err, table.name)
+			return nil
+		}
+	}
+
+	exec, err := table.base.beginExec()
+	if err != nil {
+		table.base.errorHandler("data.creates.begin", err, table.name)
+		return nil
+	}
+
+	for start := 0; start < len(items); start += size {
+		end := start + size
+		if end > len(items) {
+			end = len(items)
+		}
+
+		//行里没有的字段使用默认值
+		rows, vals := []string{}, make([]interface{}, 0)
+		for _, newValue := range newValues[start:end] {
+			tags := []string{}
+			for _, k := range keys {
+				if v, ok := newValue[k]; ok {
+					vals = append(vals, v)
+					tags = append(tags, fmt.Sprintf("$%d", len(vals)))
+				} else {
+					tags = append(tags, "DEFAULT")
+				}
+			}
+			rows = append(rows, fmt.Sprintf("(%s)", strings.Join(tags, ",")))
+		}
+
+		var sql string
+		if len(keys) > 0 {
+			sql = fmt.Sprintf(`INSERT INTO "%s"."%s" ("%s") VALUES %s RETURNING "%s";`, table.schema, table.view, strings.Join(keys, `","`), strings.Join(rows, ","), strings.Join(table.keys, `","`))
+		} else {
+			//全部使用默认值
+			sql = fmt.Sprintf(`INSERT INTO "%s"."%s" SELECT FROM generate_series(1,%d) RETURNING "%s";`, table.schema, table.view, end-start, strings.Join(table.keys, `","`))
+		}
+
+		result, err := exec.QueryContext(table.base.ctx, sql, vals...)
+		if err != nil {
+			table.base.errorHandler("data.creates.query", err, table.name, sql)
+			return nil
+		}
+
+		//RETURNING按VALUES的顺序返回
+		i := start
+		for result.Next() {
+			ids := make([]interface{}, len(table.keys))
+			pIds := make([]interface{}, len(table.keys))
+			for j := range ids {
+				pIds[j] = &ids[j]
+			}
+			if err := result.Scan(pIds...); err != nil {
+				result.Close()
+				table.base.errorHandler("data.creates.scan", err, table.name, sql)
+				return nil
+			}
+			idm, err := table.keyMapping(table.keys, ids)
+			if err != nil {
+				result.Close()
+				table.base.errorHandler("data.creates.mapping", err, table.name, sql)
+				return nil
+			}
+			if i < end {
+				for k, v := range idm {
+					values[i][k] = v
+				}
+			}
+			i++
+		}
+		result.Close()
+
+		if err := result.Err(); err != nil {
+			table.base.errorHandler("data.creates.next", err, table.name, sql)
+			return nil
+		}
+	}
+
+	//触发器，每行一个
+	for _, value := range values {
+		table.base.trigger(data.CreateTrigger, Map{"base": table.base.name, "table": table.name, "entity": value, table.key: value[table.key]})
+	}
+
+	if auto {
+		if err := table.base.Submit(); err != nil {
+			table.base.errorHandler("data.creates.submit", err, table.name)
+			return nil
+		}
+	}
+
+	return values
 }
 
 // 修改对象
 func (table *PostgresTable) Change(item Map, dddd Map) Map {
 	table.base.lastError = nil
 
-	if item == nil || item[table.key] == nil {
+	if item == nil {
 		table.base.errorHandler("data.change.empty", errors.New("无效数据"), table.name)
 		return nil
 	}
@@ -113,7 +309,7 @@ func (table *PostgresTable) Change(item Map, dddd Map) Map {
 	i := 1
 	for k, v := range newValue {
 		//主值不在修改之中
-		if k == table.key {
+		if table.isKey(k) {
 			continue
 		} else if k == INC {
 			if vm, ok := v.(Map); ok {
@@ -148,8 +344,13 @@ func (table *PostgresTable) Change(item Map, dddd Map) Map {
 			}
 		}
 	}
-	//条件是主键
-	vals = append(vals, item[table.key])
+	//条件是主键，联合主键时全部主键
+	where, ids, err := table.keyWhere(i, item)
+	if err != nil {
+		table.base.errorHandler("data.change.key", err, table.name)
+		return nil
+	}
+	vals = append(vals, ids...)
 
 	//开启事务
 	exec, err := table.base.beginExec()
@@ -159,8 +360,8 @@ func (table *PostgresTable) Change(item Map, dddd Map) Map {
 	}
 
 	//更新数据库
-	sql := fmt.Sprintf(`UPDATE "%s"."%s" SET %s WHERE "%s"=$%d`, table.schema, table.view, strings.Join(sets, `,`), table.key, i)
-	_, err = exec.Exec(sql, vals...)
+	sql := fmt.Sprintf(`UPDATE "%s"."%s" SET %s WHERE %s`, table.schema, table.view, strings.Join(sets, `,`), where)
+	_, err = exec.ExecContext(table.base.ctx, sql, vals...)
 	if err != nil {
 		table.base.errorHandler("data.change.exec", err, table.name, sql, vals)
 		return nil
@@ -185,6 +386,178 @@ func (table *PostgresTable) Change(item Map, dddd Map) Map {
 	return newItem
 }
 
+// 插入或更新，冲突时覆盖除冲突字段外的全部字段
+// conflict为冲突判断的字段，默认为主键
+func (table *PostgresTable) Upsert(dddd Map, conflict ...string) Map {
+	return table.UpsertWith(dddd, PostgresUpsert{Conflict: conflict})
+}
+
+// 插入或更新，指定覆盖或累加的字段，或是冲突时不做修改
+// 按实际发生的插入或更新，执行创建或修改触发器
+func (table *PostgresTable) UpsertWith(dddd Map, opts PostgresUpsert) Map {
+	table.base.lastError = nil
+
+	//按字段生成值
+	value := Map{}
+	errm := infra.Mapping(table.fields, dddd, value, false, false)
+	if errm.Fail() {
+		table.base.errorHandler("data.upsert.parse", errm, table.name, value)
+		return nil
+	}
+
+	//对拿到的值进行包装，以适合postgres
+	newValue := table.base.packing(value)
+
+	keys, tags, vals := []string{}, []string{}, make([]interface{}, 0)
+	for k, v := range newValue {
+		if table.isKey(k) && v == nil {
+			continue
+		}
+		keys = append(keys, k)
+		vals = append(vals, v)
+		tags = append(tags, fmt.Sprintf("$%d", len(vals)))
+	}
+
+	conflicts := opts.Conflict
+	if len(conflicts) == 0 {
+		conflicts = table.keys
+	}
+
+	//冲突时的修改
+	skips := map[string]bool{}
+	for _, k := range conflicts {
+		skips[k] = true
+	}
+	for _, k := range opts.Increment {
+		skips[k] = true
+	}
+	updates := opts.Update
+	if len(updates) == 0 {
+		for _, k := range keys {
+			if !skips[k] {
+				updates = append(updates, k)
+			}
+		}
+	}
+
+	sets := []string{}
+	if !opts.Nothing {
+		for _, k := range updates {
+			if _, ok := newValue[k]; ok && !skips[k] {
+				sets = append(sets, fmt.Sprintf(`"%s"=EXCLUDED."%s"`, k, k))
+			}
+		}
+		for _, k := range opts.Increment {
+			if _, ok := newValue[k]; ok {
+				sets = append(sets, fmt.Sprintf(`"%s"=COALESCE("this"."%s",0)+EXCLUDED."%s"`, k, k, k))
+			}
+		}
+	}
+
+	action := "DO NOTHING"
+	if len(sets) > 0 {
+		action = fmt.Sprintf("DO UPDATE SET %s", strings.Join(sets, ","))
+	}
+
+	exec, err := table.base.beginExec()
+	if err != nil {
+		table.base.errorHandler("data.upsert.begin", err, table.name)
+		return nil
+	}
+
+	insert := fmt.Sprintf(
+		`INSERT INTO "%s"."%s" AS "this" ("%s") VALUES (%s) ON CONFLICT ("%s") %s`,
+		table.schema, table.view, strings.Join(keys, `","`), strings.Join(tags, `,`), strings.Join(conflicts, `","`), action,
+	)
+
+	//_inserted区分是插入还是更新
+	var sql string
+	if table.base.connect.setting.Dialect != DialectCockroach {
+		//xmax为0表示是新插入的行
+		sql = fmt.Sprintf(`%s RETURNING *, (xmax = 0) AS "_inserted";`, insert)
+	} else {
+		//cockroach没有xmax，先在同一条语句中查冲突的行是否已存在
+		//cockroach的语句是可串行化的，不会有并发插入的问题
+		wheres := []string{}
+		for _, k := range conflicts {
+			index := -1
+			for i, key := range keys {
+				if key == k {
+					index = i
+				}
+			}
+			if index < 0 {
+				//冲突字段没有值，不可能冲突
+				wheres = []string{"false"}
+				break
+			}
+			wheres = append(wheres, fmt.Sprintf(`"%s"=%s`, k, tags[index]))
+		}
+		sql = fmt.Sprintf(
+			`WITH "existing" AS (SELECT 1 FROM "%s"."%s" WHERE %s), "upsert" AS (%s RETURNING *) SELECT "upsert".*, NOT EXISTS (SELECT 1 FROM "existing") AS "_inserted" FROM "upsert";`,
+			table.schema, table.view, strings.Join(wheres, " AND "), insert,
+		)
+	}
+	rows, err := exec.QueryContext(table.base.ctx, sql, vals...)
+	if err != nil {
+		table.base.errorHandler("data.upsert.query", err, table.name, sql, vals)
+		return nil
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		table.base.errorHandler("data.upsert.columns", err, table.name, sql)
+		return nil
+	}
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			table.base.errorHandler("data.upsert.next", err, table.name, sql)
+			return nil
+		}
+		rows.Close()
+
+		//DO NOTHING冲突时没有返回行，查询已有的行
+		//表的读取走主库，不会因为副本延迟读不到
+		where := Map{}
+		for _, k := range conflicts {
+			where[k] = value[k]
+		}
+		return table.First(where)
+	}
+
+	values := make([]interface{}, len(cols))
+	pValues := make([]interface{}, len(cols))
+	for i := range values {
+		pValues[i] = &values[i]
+	}
+	if err := rows.Scan(pValues...); err != nil {
+		table.base.errorHandler("data.upsert.scan", err, table.name)
+		return nil
+	}
+
+	m := table.base.unpacking(cols, values)
+	inserted, _ := m["_inserted"].(bool)
+	delete(m, "_inserted")
+
+	item := Map{}
+	errm = infra.Mapping(table.fields, m, item, false, true)
+	if errm.Fail() {
+		table.base.errorHandler("data.upsert.mapping", errm, table.name)
+		return nil
+	}
+
+	//触发器
+	if inserted {
+		table.base.trigger(data.CreateTrigger, Map{"base": table.base.name, "table": table.name, "entity": item, table.key: item[table.key]})
+	} else {
+		table.base.trigger(data.ChangeTrigger, Map{"base": table.base.name, "table": table.name, table.key: item[table.key], "entity": item, "after": item})
+	}
+
+	return item
+}
+
 //删除对象
 //func (table *PostgresTable) Remove(items ...Map) int64 {
 //	table.base.lastError = nil
@@ -323,9 +696,9 @@ func (table *PostgresTable) Remove(args ...Any) Map {
 			return nil
 		}
 		if vv, ok := args[0].(Map); ok {
-			if id, ok := vv[table.key]; ok {
+			if _, _, err := table.keyWhere(1, vv); err == nil {
 				args = []Any{
-					Map{table.key: id},
+					table.keyValues(vv),
 				}
 			}
 		}
@@ -336,6 +709,10 @@ func (table *PostgresTable) Remove(args ...Any) Map {
 		table.base.errorHandler("data.remove.first", err, table.name)
 		return nil
 	}
+	if item == nil {
+		//记录不存在，不用删除
+		return nil
+	}
 
 	//开启事务
 	exec, err := table.base.beginExec()
@@ -344,10 +721,17 @@ func (table *PostgresTable) Remove(args ...Any) Map {
 		return nil
 	}
 
-	sql := fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE %s=$1`, table.schema, table.view, table.key)
-	_, err = exec.Exec(sql, item[table.key])
+	//联合主键时全部主键作为条件
+	where, ids, err := table.keyWhere(1, item)
+	if err != nil {
+		table.base.errorHandler("data.remove.key", err, table.name)
+		return nil
+	}
+
+	sql := fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE %s`, table.schema, table.view, where)
+	_, err = exec.ExecContext(table.base.ctx, sql, ids...)
 	if err != nil {
-		table.base.errorHandler("data.remove.exec", err, table.name, sql, item[table.key])
+		table.base.errorHandler("data.remove.exec", err, table.name, sql, ids)
 		return nil
 	}
 
@@ -378,7 +762,7 @@ func (table *PostgresTable) Delete(args ...Any) int64 {
 	}
 
 	sql := fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE %s`, table.schema, table.view, where)
-	result, err := exec.Exec(sql, builds...)
+	result, err := exec.ExecContext(table.base.ctx, sql, builds...)
 	if err != nil {
 		table.base.errorHandler("data.delete.begin", err, table.name, sql, builds)
 		return int64(0)
@@ -435,7 +819,7 @@ func (table *PostgresTable) Update(update Map, args ...Any) int64 {
 	i := 1
 	for k, v := range newValue {
 		//主值不在修改之中
-		if k == table.key {
+		if table.isKey(k) {
 			continue
 		} else if k == INC {
 			if vm, ok := v.(Map); ok {
@@ -495,7 +879,7 @@ func (table *PostgresTable) Update(update Map, args ...Any) int64 {
 
 	//更新数据库
 	sql := fmt.Sprintf(`UPDATE "%s"."%s" SET %s WHERE %s`, table.schema, table.view, strings.Join(sets, `,`), where)
-	result, err := exec.Exec(sql, vals...)
+	result, err := exec.ExecContext(table.base.ctx, sql, vals...)
 	if err != nil {
 		table.base.errorHandler("data.update.exec", err, table.name, sql, vals)
 		return int64(0)
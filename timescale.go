@@ -0,0 +1,233 @@
+package data_postgres
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/infrago/base"
+	"github.com/infrago/log"
+)
+
+type (
+	//超表设置，Time为时间字段，Chunk为分块间隔
+	PostgresHypertable struct {
+		Time  string
+		Chunk string
+	}
+
+	//连续聚合设置
+	//Time为时间字段，为空时使用超表设置中的字段
+	//Bucket为分桶间隔，Columns为聚合的字段列表，比如 avg("value") AS "value"
+	//Groups为除时间桶外的分组字段，Start/End/Schedule为刷新策略
+	PostgresAggregate struct {
+		View     string
+		Time     string
+		Bucket   string
+		Columns  []string
+		Groups   []string
+		Start    string
+		End      string
+		Schedule string
+	}
+)
+
+// 生成INTERVAL表达式
+func interval(value string) string {
+	return fmt.Sprintf(`INTERVAL '%s'`, strings.Replace(strings.TrimSpace(value), "'", "''", -1))
+}
+
+// 解析表配置中的超表设置，没有时返回nil
+// setting: { hypertable: { time: "created", chunk: "1 day" } }，只指定时间字段的可以直接写 hypertable: "created"
+func hypertableSetting(setting Map) *PostgresHypertable {
+	switch vv := setting["hypertable"].(type) {
+	case string:
+		if vv != "" {
+			return &PostgresHypertable{Time: vv}
+		}
+	case Map:
+		config := &PostgresHypertable{}
+		if time, ok := vv["time"].(string); ok {
+			config.Time = time
+		}
+		if chunk, ok := vv["chunk"].(string); ok {
+			config.Chunk = chunk
+		}
+		return config
+	}
+	return nil
+}
+
+// 按表配置把表转为超表
+// 会加锁并迁移已有数据，在建表之后作为初始化步骤调用，不要放在写入流程中
+func (base *PostgresBase) Hypertable(name string) error {
+	base.lastError = nil
+
+	if base.connect.setting.Dialect != DialectTimescale {
+		base.errorHandler("data.hypertable.dialect", errors.New("[数据]超表仅支持timescale"), name)
+		return base.lastError
+	}
+
+	table := base.Table(name).(*PostgresTable)
+	config := table.hypertable
+	if config == nil || config.Time == "" {
+		base.errorHandler("data.hypertable.time", errors.New("[数据]超表缺少时间字段"), name)
+		return base.lastError
+	}
+
+	exec, err := base.beginExec()
+	if err != nil {
+		base.errorHandler("data.hypertable.begin", err, name)
+		return base.lastError
+	}
+
+	sql := fmt.Sprintf(`SELECT create_hypertable('"%s"."%s"', '%s', if_not_exists => TRUE, migrate_data => TRUE`, table.schema, table.view, config.Time)
+	if config.Chunk != "" {
+		sql += fmt.Sprintf(`, chunk_time_interval => %s`, interval(config.Chunk))
+	}
+	sql += ")"
+
+	_, err = exec.ExecContext(base.ctx, sql)
+	if err != nil {
+		base.errorHandler("data.hypertable.exec", err, name, sql)
+		return base.lastError
+	}
+
+	return nil
+}
+
+// 开启压缩，并添加压缩策略
+// after为多久之前的数据进行压缩，segments为压缩的分段字段
+func (base *PostgresBase) Compression(name string, after string, segments ...string) {
+	base.lastError = nil
+
+	if base.connect.setting.Dialect != DialectTimescale {
+		base.errorHandler("data.compression.dialect", errors.New("[数据]压缩策略仅支持timescale"), name)
+		return
+	}
+
+	table := base.Table(name).(*PostgresTable)
+
+	exec, err := base.beginExec()
+	if err != nil {
+		base.errorHandler("data.compression.begin", err, name)
+		return
+	}
+
+	sql := fmt.Sprintf(`ALTER TABLE "%s"."%s" SET (timescaledb.compress`, table.schema, table.view)
+	if len(segments) > 0 {
+		sql += fmt.Sprintf(`, timescaledb.compress_segmentby = '"%s"'`, strings.Join(segments, `","`))
+	}
+	sql += ")"
+
+	_, err = exec.ExecContext(base.ctx, sql)
+	if err != nil {
+		base.errorHandler("data.compression.alter", err, name, sql)
+		return
+	}
+
+	sql = fmt.Sprintf(`SELECT add_compression_policy('"%s"."%s"', %s, if_not_exists => TRUE)`, table.schema, table.view, interval(after))
+	_, err = exec.ExecContext(base.ctx, sql)
+	if err != nil {
+		base.errorHandler("data.compression.policy", err, name, sql)
+		return
+	}
+}
+
+// 添加保留策略，after之前的数据会被自动删除
+func (base *PostgresBase) Retention(name string, after string) {
+	base.lastError = nil
+
+	if base.connect.setting.Dialect != DialectTimescale {
+		base.errorHandler("data.retention.dialect", errors.New("[数据]保留策略仅支持timescale"), name)
+		return
+	}
+
+	table := base.Table(name).(*PostgresTable)
+
+	exec, err := base.beginExec()
+	if err != nil {
+		base.errorHandler("data.retention.begin", err, name)
+		return
+	}
+
+	sql := fmt.Sprintf(`SELECT add_retention_policy('"%s"."%s"', %s, if_not_exists => TRUE)`, table.schema, table.view, interval(after))
+	_, err = exec.ExecContext(base.ctx, sql)
+	if err != nil {
+		base.errorHandler("data.retention.policy", err, name, sql)
+		return
+	}
+}
+
+// 创建连续聚合，并添加刷新策略
+// 注意：连续聚合不能在事务中创建
+func (base *PostgresBase) Aggregate(name string, config PostgresAggregate) {
+	base.lastError = nil
+
+	if base.connect.setting.Dialect != DialectTimescale {
+		base.errorHandler("data.aggregate.dialect", errors.New("[数据]连续聚合仅支持timescale"), name)
+		return
+	}
+	if base.manual {
+		//不能用errorHandler，会取消调用方的事务
+		err := errors.New("[数据]连续聚合不能在事务中创建")
+		base.lastError = err
+		log.Warning("data.aggregate.manual", err, name)
+		return
+	}
+
+	table := base.Table(name).(*PostgresTable)
+
+	time := config.Time
+	if time == "" && table.hypertable != nil {
+		time = table.hypertable.Time
+	}
+	if time == "" || config.View == "" || config.Bucket == "" || len(config.Columns) == 0 {
+		base.errorHandler("data.aggregate.config", errors.New("[数据]无效的连续聚合设置"), name)
+		return
+	}
+
+	exec, err := base.beginExec()
+	if err != nil {
+		base.errorHandler("data.aggregate.begin", err, name)
+		return
+	}
+
+	columns := []string{fmt.Sprintf(`time_bucket(%s, "%s") AS "%s"`, interval(config.Bucket), time, time)}
+	groups := []string{"1"}
+	for _, group := range config.Groups {
+		columns = append(columns, fmt.Sprintf(`"%s"`, group))
+		groups = append(groups, fmt.Sprintf(`"%s"`, group))
+	}
+	columns = append(columns, config.Columns...)
+
+	sql := fmt.Sprintf(
+		`CREATE MATERIALIZED VIEW IF NOT EXISTS "%s"."%s" WITH (timescaledb.continuous) AS SELECT %s FROM "%s"."%s" GROUP BY %s WITH NO DATA`,
+		table.schema, config.View, strings.Join(columns, ","), table.schema, table.view, strings.Join(groups, ","),
+	)
+	_, err = exec.ExecContext(base.ctx, sql)
+	if err != nil {
+		base.errorHandler("data.aggregate.create", err, name, sql)
+		return
+	}
+
+	if config.Schedule != "" {
+		start, end := "NULL", "NULL"
+		if config.Start != "" {
+			start = interval(config.Start)
+		}
+		if config.End != "" {
+			end = interval(config.End)
+		}
+
+		sql = fmt.Sprintf(
+			`SELECT add_continuous_aggregate_policy('"%s"."%s"', start_offset => %s, end_offset => %s, schedule_interval => %s, if_not_exists => TRUE)`,
+			table.schema, config.View, start, end, interval(config.Schedule),
+		)
+		_, err = exec.ExecContext(base.ctx, sql)
+		if err != nil {
+			base.errorHandler("data.aggregate.policy", err, name, sql)
+			return
+		}
+	}
+}
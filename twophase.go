@@ -0,0 +1,195 @@
+package data_postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/infrago/data"
+	"github.com/infrago/log"
+)
+
+type (
+	//已预提交的事务，提交或回滚后才执行触发器和回调
+	postgresPrepared struct {
+		gid       string
+		triggers  []postgresTrigger
+		commits   []func()
+		rollbacks []func()
+	}
+
+	//数据库中待决的预提交事务
+	PostgresPrepared struct {
+		Gid      string
+		Prepared time.Time
+		Owner    string
+		Database string
+	}
+
+	//两阶段提交协调器，驱动多个base一起提交
+	//每个base使用 gid_序号 作为自己的事务ID
+	PostgresCoordinator struct {
+		gid   string
+		bases []*PostgresBase
+	}
+)
+
+// 引用事务ID
+func quoteGid(gid string) string {
+	return fmt.Sprintf(`'%s'`, strings.Replace(gid, "'", "''", -1))
+}
+
+// 预提交事务，之后需要CommitPrepared或RollbackPrepared
+// 需要数据库开启max_prepared_transactions
+func (base *PostgresBase) Prepare(gid string) error {
+	if gid == "" {
+		return errors.New("[数据]无效的事务ID")
+	}
+	if base.tx == nil || base.nested() {
+		return errors.New("[数据]只有最外层事务可以预提交")
+	}
+
+	_, err := base.tx.ExecContext(base.ctx, fmt.Sprintf(`PREPARE TRANSACTION %s`, quoteGid(gid)))
+	if err != nil {
+		base.errorHandler("data.prepare", err, base.name, gid)
+		return err
+	}
+
+	//PREPARE之后连接上已经没有事务了，还要结束sql.Tx把连接还给连接池
+	if err := releasePrepared(base.ctx, base.tx); err != nil {
+		log.Warning("data.prepare.release", base.name, gid, err)
+	}
+
+	base.prepared = &postgresPrepared{gid, base.triggers, base.commits, base.rollbacks}
+	base.endTx()
+
+	return nil
+}
+
+// 预提交之后结束sql.Tx
+// lib/pq提交或回滚时会检查连接是否在事务中，不在的话会把连接标记为坏连接丢弃
+// 所以先开一个空事务，再回滚它，两种驱动都可以正常归还连接
+func releasePrepared(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, `BEGIN`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Rollback()
+}
+
+// 提交预提交的事务
+// 可以用于恢复其它进程留下的事务，这时没有触发器和回调
+func (base *PostgresBase) CommitPrepared(gid string) error {
+	_, err := base.connect.db.ExecContext(base.ctx, fmt.Sprintf(`COMMIT PREPARED %s`, quoteGid(gid)))
+	if err != nil {
+		return err
+	}
+
+	if prepared := base.prepared; prepared != nil && prepared.gid == gid {
+		base.prepared = nil
+		for _, trigger := range prepared.triggers {
+			data.Trigger(trigger.Name, trigger.Value)
+		}
+		for _, hook := range prepared.commits {
+			hook()
+		}
+	}
+
+	return nil
+}
+
+// 回滚预提交的事务
+func (base *PostgresBase) RollbackPrepared(gid string) error {
+	_, err := base.connect.db.ExecContext(base.ctx, fmt.Sprintf(`ROLLBACK PREPARED %s`, quoteGid(gid)))
+	if err != nil {
+		return err
+	}
+
+	if prepared := base.prepared; prepared != nil && prepared.gid == gid {
+		base.prepared = nil
+		for _, hook := range prepared.rollbacks {
+			hook()
+		}
+	}
+
+	return nil
+}
+
+// 列出当前数据库中待决的预提交事务，prefix为空时列出全部
+// 重启后可以根据这个列表决定提交还是回滚
+func (base *PostgresBase) Prepared(prefix string) ([]PostgresPrepared, error) {
+	rows, err := base.connect.db.QueryContext(
+		base.ctx,
+		`SELECT gid, prepared, owner, database FROM pg_prepared_xacts WHERE database=current_database() AND gid LIKE $1 ORDER BY prepared`,
+		strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)+"%",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prepareds := []PostgresPrepared{}
+	for rows.Next() {
+		prepared := PostgresPrepared{}
+		if err := rows.Scan(&prepared.Gid, &prepared.Prepared, &prepared.Owner, &prepared.Database); err != nil {
+			return nil, err
+		}
+		prepareds = append(prepareds, prepared)
+	}
+
+	return prepareds, rows.Err()
+}
+
+// 创建两阶段提交协调器
+// bases需要已经Begin，并完成了各自的写入
+func NewCoordinator(gid string, bases ...*PostgresBase) *PostgresCoordinator {
+	return &PostgresCoordinator{gid: gid, bases: bases}
+}
+
+// 某个base的事务ID
+func (coordinator *PostgresCoordinator) Gid(i int) string {
+	return fmt.Sprintf("%s_%d", coordinator.gid, i)
+}
+
+// 两阶段提交
+// 第一阶段全部预提交，有失败的就全部回滚
+// 第二阶段全部提交，失败的事务保持待决，需要用Prepared列出后处理
+func (coordinator *PostgresCoordinator) Submit() error {
+	for i, base := range coordinator.bases {
+		if err := base.Prepare(coordinator.Gid(i)); err != nil {
+			//已预提交的回滚，未预提交的取消，包括预提交失败的这个
+			//有嵌套事务的话整个事务都要回滚
+			for j, other := range coordinator.bases {
+				if j < i {
+					if rerr := other.RollbackPrepared(coordinator.Gid(j)); rerr != nil {
+						log.Warning("data.coordinator.rollback", coordinator.Gid(j), rerr)
+					}
+				} else if other.tx != nil {
+					other.savepoints = nil
+					other.Cancel()
+				}
+			}
+			return err
+		}
+	}
+
+	var lastErr error
+	for i, base := range coordinator.bases {
+		if err := base.CommitPrepared(coordinator.Gid(i)); err != nil {
+			log.Warning("data.coordinator.commit", coordinator.Gid(i), err)
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// 全部取消
+func (coordinator *PostgresCoordinator) Cancel() {
+	for _, base := range coordinator.bases {
+		base.Cancel()
+	}
+}
@@ -14,14 +14,124 @@ import (
 type (
 	PostgresView struct {
 		base   *PostgresBase
-		name   string //模型名称
-		schema string //架构名
-		view   string //视图名
-		key    string //主键
-		fields Vars   //字段定义
+		name   string   //模型名称
+		schema string   //架构名
+		view   string   //视图名
+		key    string   //主键，联合主键时为第一个
+		keys   []string //全部主键字段
+		fields Vars     //字段定义
+		asof   string   //cockroach的AS OF SYSTEM TIME
+
+		//读取也使用主库，表使用，保证能读到刚写入的数据
+		primary bool
 	}
 )
 
+// 读取的执行器，表走主库，视图优先只读副本
+func (view *PostgresView) readExec() (PostgresExecutor, error) {
+	if view.primary {
+		return view.base.primaryExec()
+	}
+	return view.base.readExec()
+}
+
+// 拆分主键配置，联合主键用逗号分隔
+func splitKeys(key string) []string {
+	keys := []string{}
+	for _, k := range strings.Split(key, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		keys = append(keys, "id")
+	}
+	return keys
+}
+
+// 是否主键字段
+func (view *PostgresView) isKey(field string) bool {
+	for _, k := range view.keys {
+		if k == field {
+			return true
+		}
+	}
+	return false
+}
+
+// 按主键生成条件，参数从$start开始
+// id可以是单个值，联合主键时为Map或按主键顺序的数组
+func (view *PostgresView) keyWhere(start int, id Any) (string, []Any, error) {
+	vals := []Any{}
+	switch vv := id.(type) {
+	case Map:
+		for _, k := range view.keys {
+			if vv[k] == nil {
+				return "", nil, fmt.Errorf("[数据]缺少主键：%s", k)
+			}
+			vals = append(vals, vv[k])
+		}
+	case []Any:
+		if len(vv) != len(view.keys) {
+			return "", nil, errors.New("[数据]主键数量不匹配")
+		}
+		vals = append(vals, vv...)
+	default:
+		if len(view.keys) > 1 {
+			return "", nil, errors.New("[数据]联合主键需要使用Map或数组")
+		}
+		vals = append(vals, id)
+	}
+
+	wheres := []string{}
+	for i, k := range view.keys {
+		wheres = append(wheres, fmt.Sprintf(`"%s"=$%d`, k, start+i))
+	}
+	return strings.Join(wheres, " AND "), vals, nil
+}
+
+// 取出主键值，用于触发器和条件
+func (view *PostgresView) keyValues(item Map) Map {
+	values := Map{}
+	for _, k := range view.keys {
+		values[k] = item[k]
+	}
+	return values
+}
+
+// 把RETURNING返回的主键转成字段定义的类型
+func (view *PostgresView) keyMapping(cols []string, vals []interface{}) (Map, error) {
+	m := view.base.unpacking(cols, vals)
+
+	fields := Vars{}
+	for _, k := range cols {
+		if field, ok := view.fields[k]; ok {
+			fields[k] = field
+		}
+	}
+
+	item := Map{}
+	errm := infra.Mapping(fields, m, item, false, true)
+	if errm.Fail() {
+		return nil, errm
+	}
+	//没有字段定义的主键直接使用
+	for k, v := range m {
+		if _, ok := item[k]; !ok {
+			item[k] = v
+		}
+	}
+	return item, nil
+}
+
+// 查询来源，非手动事务时带上AS OF SYSTEM TIME
+func (view *PostgresView) source() string {
+	if view.asof != "" && !view.base.manual {
+		return fmt.Sprintf(`"%s"."%s" AS OF SYSTEM TIME %s`, view.schema, view.view, view.asof)
+	}
+	return fmt.Sprintf(`"%s"."%s"`, view.schema, view.view)
+}
+
 // 统计数量
 // 添加函数支持
 // 函数(字段）
@@ -57,14 +167,14 @@ func (view *PostgresView) Count(args ...Any) float64 {
 		return float64(0)
 	}
 
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.count.begin", err, view.name)
 		return float64(0)
 	}
 
-	sql := fmt.Sprintf(`SELECT %v(%v) FROM "%s"."%s" WHERE %s`, countFunc, countField, view.schema, view.view, where)
-	rows, err := exec.Query(sql, builds...)
+	sql := fmt.Sprintf(`SELECT %v(%v) FROM %s WHERE %s`, countFunc, countField, view.source(), where)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...)
 	if err != nil {
 		view.base.errorHandler("data.count.query", err, view.name, sql, builds)
 		return float64(0)
@@ -108,6 +218,13 @@ func (view *PostgresView) Count(args ...Any) float64 {
 func (view *PostgresView) First(args ...Any) Map {
 	view.base.lastError = nil
 
+	//行锁，只能在手动事务中使用
+	lock, args, err := view.base.locking(args...)
+	if err != nil {
+		view.base.errorHandler("data.first.lock", err, view.name)
+		return nil
+	}
+
 	//生成查询条件
 	where, builds, orderby, err := view.base.parsing(1, args...)
 	if err != nil {
@@ -116,14 +233,14 @@ func (view *PostgresView) First(args ...Any) Map {
 	}
 
 	//获取
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.first.begin", err, view.name)
 		return nil
 	}
 
-	sql := fmt.Sprintf(`SELECT * FROM "%s"."%s" WHERE %s %s LIMIT 1`, view.schema, view.view, where, orderby)
-	rows, err := exec.Query(sql, builds...)
+	sql := fmt.Sprintf(`SELECT * FROM %s WHERE %s %s LIMIT 1 %s`, view.source(), where, orderby, lock)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...)
 	if err != nil {
 		view.base.errorHandler("data.first.query", err, view.name, err, sql, builds)
 		return nil
@@ -174,6 +291,13 @@ func (view *PostgresView) First(args ...Any) Map {
 func (view *PostgresView) Query(args ...Any) []Map {
 	view.base.lastError = nil
 
+	//行锁，只能在手动事务中使用
+	lock, args, err := view.base.locking(args...)
+	if err != nil {
+		view.base.errorHandler("data.query.lock", err, view.name)
+		return []Map{}
+	}
+
 	//生成查询条件
 	where, builds, orderby, err := view.base.parsing(1, args...)
 	if err != nil {
@@ -181,14 +305,14 @@ func (view *PostgresView) Query(args ...Any) []Map {
 		return []Map{}
 	}
 
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.query.begin", err, view.name)
 		return []Map{}
 	}
 
-	sql := fmt.Sprintf(`SELECT * FROM "%s"."%s" WHERE %s %s`, view.schema, view.view, where, orderby)
-	rows, err := exec.Query(sql, builds...)
+	sql := fmt.Sprintf(`SELECT * FROM %s WHERE %s %s %s`, view.source(), where, orderby, lock)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...)
 	if err != nil {
 		view.base.errorHandler("data.query.query", err, view.name, sql, builds)
 		return []Map{}
@@ -251,6 +375,13 @@ func (view *PostgresView) LimitRange(limit int64, next data.RangeFunc, args ...A
 
 	view.base.lastError = nil
 
+	//行锁，只能在手动事务中使用
+	lock, args, err := view.base.locking(args...)
+	if err != nil {
+		view.base.errorHandler("data.range.lock", err, view.name)
+		return infra.Fail
+	}
+
 	//生成查询条件
 	where, builds, orderby, err := view.base.parsing(1, args...)
 	if err != nil {
@@ -258,14 +389,14 @@ func (view *PostgresView) LimitRange(limit int64, next data.RangeFunc, args ...A
 		return infra.Fail
 	}
 
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.range.begin", err, view.name)
 		return infra.Fail
 	}
 
-	sql := fmt.Sprintf(`SELECT * FROM "%s"."%s" WHERE %s %s`, view.schema, view.view, where, orderby)
-	rows, err := exec.Query(sql, builds...)
+	sql := fmt.Sprintf(`SELECT * FROM %s WHERE %s %s %s`, view.source(), where, orderby, lock)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...)
 	if err != nil {
 		view.base.errorHandler("data.range.query", err, view.name, sql, builds)
 		return infra.Fail
@@ -334,15 +465,15 @@ func (view *PostgresView) Limit(offset, limit Any, args ...Any) (int64, []Map) {
 	}
 
 	//开启事务
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.limit.begin", err, view.name)
 		return int64(0), []Map{}
 	}
 
 	//先统计，COUNT(*) QueryRow支持，Query不支持
-	sql := fmt.Sprintf(`SELECT COUNT("%v") FROM "%s"."%s" WHERE %s`, view.key, view.schema, view.view, where)
-	row := exec.QueryRow(sql, builds...)
+	sql := fmt.Sprintf(`SELECT COUNT("%v") FROM %s WHERE %s`, view.key, view.source(), where)
+	row := exec.QueryRowContext(view.base.ctx, sql, builds...)
 	if row == nil {
 		view.base.errorHandler("data.limit.count", errors.New("统计失败"))
 		return int64(0), []Map{}
@@ -356,8 +487,8 @@ func (view *PostgresView) Limit(offset, limit Any, args ...Any) (int64, []Map) {
 		return int64(0), []Map{}
 	}
 
-	sql = fmt.Sprintf(`SELECT * FROM "%s"."%s" WHERE %s %s OFFSET %d LIMIT %d`, view.schema, view.view, where, orderby, offset, limit)
-	rows, err := exec.Query(sql, builds...)
+	sql = fmt.Sprintf(`SELECT * FROM %s WHERE %s %s OFFSET %d LIMIT %d`, view.source(), where, orderby, offset, limit)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...)
 	if err != nil {
 		view.base.errorHandler("data.limit.query", err, view.name)
 		return int64(0), []Map{}
@@ -412,6 +543,19 @@ func (view *PostgresView) Limit(offset, limit Any, args ...Any) (int64, []Map) {
 func (view *PostgresView) Group(field string, args ...Any) []Map {
 	view.base.lastError = nil
 
+	//支持时间分桶，字段:间隔，比如 created:1 hour
+	//仅timescale下可用，按桶的时间顺序排序
+	column, groupby, bucket := fmt.Sprintf(`"%s"`, field), fmt.Sprintf(`"%s"`, field), false
+	if dots := strings.SplitN(field, ":", 2); len(dots) == 2 {
+		if view.base.connect.setting.Dialect != DialectTimescale {
+			view.base.errorHandler("data.group.bucket", errors.New("[数据]time_bucket仅支持timescale"), view.name, field)
+			return []Map{}
+		}
+		field = dots[0]
+		column = fmt.Sprintf(`time_bucket(%s, "%s") AS "%s"`, interval(dots[1]), field, field)
+		groupby, bucket = "1", true
+	}
+
 	method := COUNT
 	count := field
 	countField := "$count"
@@ -433,23 +577,27 @@ func (view *PostgresView) Group(field string, args ...Any) []Map {
 		return []Map{}
 	}
 
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.group.begin", err, view.name)
 		return []Map{}
 	}
 
 	if orderby == "" {
-		orderby = `ORDER BY "` + countField + `" DESC`
+		if bucket {
+			orderby = `ORDER BY "` + field + `" ASC`
+		} else {
+			orderby = `ORDER BY "` + countField + `" DESC`
+		}
 	}
 
 	keys := []string{field, countField}
 
-	sql := fmt.Sprintf(`SELECT "%s",%s("%s") as "%s" FROM "%s"."%s" WHERE %s GROUP BY "%s" %s`, field, method, count, countField, view.schema, view.view, where, field, orderby)
+	sql := fmt.Sprintf(`SELECT %s,%s("%s") as "%s" FROM %s WHERE %s GROUP BY %s %s`, column, method, count, countField, view.source(), where, groupby, orderby)
 	// if limit > 0 {
 	// 	sql += fmt.Sprintf(` LIMIT %d`, limit)
 	// }
-	rows, err := exec.Query(sql, builds...)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...)
 	if err != nil {
 		view.base.errorHandler("data.group.query", err, view.name, sql)
 		return []Map{}
@@ -575,16 +723,23 @@ func (view *PostgresView) Group(field string, args ...Any) []Map {
 func (view *PostgresView) Entity(id Any) Map {
 	view.base.lastError = nil
 
+	//联合主键时全部主键作为条件
+	where, builds, err := view.keyWhere(1, id)
+	if err != nil {
+		view.base.errorHandler("data.entity.key", err, view.name, id)
+		return nil
+	}
+
 	//开启事务
-	exec, err := view.base.beginExec()
+	exec, err := view.readExec()
 	if err != nil {
 		view.base.errorHandler("data.entity.begin", err, view.name)
 		return nil
 	}
 
 	//可以用*了，因为可以拿到字段列表
-	sql := fmt.Sprintf(`SELECT * FROM "%s"."%s" WHERE "%s"=$1`, view.schema, view.view, view.key)
-	rows, err := exec.Query(sql, id) //QueryRow不支持获取字段列表
+	sql := fmt.Sprintf(`SELECT * FROM %s WHERE %s`, view.source(), where)
+	rows, err := exec.QueryContext(view.base.ctx, sql, builds...) //QueryRow不支持获取字段列表
 	if err != nil {
 		view.base.errorHandler("data.entity.query", err, view.name, sql)
 		return nil
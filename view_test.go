@@ -0,0 +1,69 @@
+package data_postgres
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/infrago/base"
+)
+
+func TestSplitKeys(t *testing.T) {
+	tests := []struct {
+		key  string
+		keys []string
+	}{
+		{"id", []string{"id"}},
+		{"tenant,id", []string{"tenant", "id"}},
+		{" tenant , id ,", []string{"tenant", "id"}},
+		{"", []string{"id"}},
+		{" , ", []string{"id"}},
+	}
+
+	for _, test := range tests {
+		if keys := splitKeys(test.key); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("%q：%q，应为%q", test.key, keys, test.keys)
+		}
+	}
+}
+
+func TestKeyWhere(t *testing.T) {
+	single := &PostgresView{keys: []string{"id"}}
+	composite := &PostgresView{keys: []string{"tenant", "id"}}
+
+	tests := []struct {
+		name  string
+		view  *PostgresView
+		start int
+		id    Any
+		where string
+		vals  []Any
+		fail  bool
+	}{
+		{"单主键", single, 1, int64(5), `"id"=$1`, []Any{int64(5)}, false},
+		{"单主键字串", single, 3, "a-b", `"id"=$3`, []Any{"a-b"}, false},
+		{"单主键Map", single, 1, Map{"id": 5}, `"id"=$1`, []Any{5}, false},
+		{"联合主键Map", composite, 2, Map{"id": 5, "tenant": "t"}, `"tenant"=$2 AND "id"=$3`, []Any{"t", 5}, false},
+		{"联合主键数组", composite, 1, []Any{"t", 5}, `"tenant"=$1 AND "id"=$2`, []Any{"t", 5}, false},
+		{"联合主键缺字段", composite, 1, Map{"id": 5}, "", nil, true},
+		{"联合主键数量不对", composite, 1, []Any{"t"}, "", nil, true},
+		{"联合主键单值", composite, 1, 5, "", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			where, vals, err := test.view.keyWhere(test.start, test.id)
+			if test.fail {
+				if err == nil {
+					t.Fatalf("应该报错，得到%s %v", where, vals)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if where != test.where || !reflect.DeepEqual(vals, test.vals) {
+				t.Fatalf("%s %v，应为%s %v", where, vals, test.where, test.vals)
+			}
+		})
+	}
+}